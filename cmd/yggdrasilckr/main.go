@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"syscall"
 
@@ -37,6 +42,9 @@ type node struct {
 	tun       *tun.TunAdapter
 	multicast *multicast.Multicast
 	admin     *admin.AdminSocket
+	config    *config.NodeConfig
+	addresses []string // Added to the TUN adapter because of InstallRoutes
+	logger    *log.Logger
 }
 
 // The main function is responsible for configuring and starting Yggdrasil.
@@ -194,12 +202,12 @@ func main() {
 		return
 	}
 
-	n := &node{}
+	n := &node{config: cfg, logger: logger}
 
 	// Setup the Yggdrasil node itself.
 	{
 		options := []core.SetupOption{
-			core.NodeInfo(cfg.NodeInfo),
+			core.NodeInfo(ckriprwc.NodeInfo(cfg.NodeInfo, &cfg.TunnelRoutingConfig)),
 			core.NodeInfoPrivacy(cfg.NodeInfoPrivacy),
 		}
 		for _, addr := range cfg.Listen {
@@ -278,11 +286,15 @@ func main() {
 		if n.admin != nil && n.tun != nil {
 			n.tun.SetupAdminHandlers(n.admin)
 		}
+		if n.tun != nil {
+			n.iprwc.SetRouteInstaller(&systemRoutes{n.tun, logger})
+		}
+		if n.admin != nil {
+			n.iprwc.SetupAdminHandlers(n.admin)
+		}
 		if n.tun != nil && cfg.InstallRoutes {
-			if len(cfg.Addresses) > 0 {
-				if err := routes.SetAddresses(n.tun, logger, cfg.Addresses); err != nil {
-					panic(err)
-				}
+			if err := n.setAddresses(cfg.Addresses); err != nil {
+				panic(err)
 			}
 			cidrs := make([]string, 0)
 			for _, nets := range cfg.RemoteSubnets {
@@ -294,14 +306,50 @@ func main() {
 			for _, cidr := range cfg.IPv6RemoteSubnets {
 				cidrs = append(cidrs, cidr)
 			}
+			for _, route := range cfg.Routes {
+				if route.Alias != "" {
+					cidrs = append(cidrs, route.Alias)
+				} else {
+					cidrs = append(cidrs, route.Subnet)
+				}
+			}
+			// Routes are installed for the subnet as CKR routes it, even if
+			// it was given as an address within it, e.g. 10.0.0.1/8.
+			for i, cidr := range cidrs {
+				if prefix, err := netip.ParsePrefix(cidr); err == nil {
+					cidrs[i] = prefix.Masked().String()
+				}
+			}
+			// The same subnet can be routed via several nodes or from
+			// several sources, but only needs one system route.
+			slices.Sort(cidrs)
+			cidrs = slices.Compact(cidrs)
 			if err := routes.SetRoutes(n.tun, logger, cidrs); err != nil {
 				panic(err)
 			}
 		}
 	}
 
-	// Block until we are told to shut down.
-	<-ctx.Done()
+	// Reload the configuration file on SIGHUP and block until we are told
+	// to shut down.
+	hup := make(chan os.Signal, 1)
+	if *useconffile != "" {
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+
+		case <-hup:
+			logger.Infoln("Reloading configuration from", *useconffile)
+			if err := n.reload(*useconffile); err != nil {
+				logger.Errorln("Configuration reload:", err)
+			}
+		}
+	}
+	signal.Stop(hup)
 
 	// Shut down the node.
 	_ = n.admin.Stop()
@@ -310,6 +358,176 @@ func main() {
 	n.core.Stop()
 }
 
+// reload re-reads the configuration file and applies any changes to the
+// tunnel routing configuration to the running node. Changes to any other
+// options can't be applied without restarting, so these are reported as
+// errors instead.
+func (n *node) reload(path string) error {
+	conf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg := &config.NodeConfig{
+		NodeConfig: yggcfg.GenerateConfig(),
+	}
+	if _, err := cfg.ReadFrom(bytes.NewReader(conf)); err != nil {
+		return err
+	}
+	if !setsPrivateKey(conf) {
+		// A new key was generated, as one was at startup, so keep the one
+		// in use rather than reporting that the key has changed.
+		cfg.PrivateKey = n.config.PrivateKey
+	}
+
+	var errs []error
+	changed, err := changedOptions(n.config.NodeConfig, cfg.NodeConfig)
+	if err != nil {
+		return err
+	}
+	for _, name := range changed {
+		errs = append(errs, fmt.Errorf("%s can't be changed without restarting", name))
+	}
+
+	// Keep running with the options that couldn't be changed, so that the
+	// next reload is compared against what is actually in use.
+	cfg.NodeConfig = n.config.NodeConfig
+	if err := n.iprwc.Reconfigure(&cfg.TunnelRoutingConfig); err != nil {
+		errs = append(errs, err)
+	}
+	if n.tun != nil {
+		var addresses []string
+		if cfg.InstallRoutes {
+			addresses = cfg.Addresses
+		}
+		if err := n.setAddresses(addresses); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	hasAddress := func(cfg *config.NodeConfig) bool {
+		return cfg.YggdrasilRouting || len(cfg.YggdrasilAllowed) > 0
+	}
+	if hasAddress(cfg) != hasAddress(n.config) {
+		n.logger.Warnln("The Yggdrasil address of the TUN adapter won't be changed until restarting")
+	}
+	// The CKR routes are changed even if the system routes couldn't be, but
+	// the published subnets aren't.
+	applied := *cfg
+	if !slices.Equal(cfg.LocalSubnets, n.config.LocalSubnets) {
+		n.logger.Warnln("The subnets published in NodeInfo won't be changed until restarting")
+		applied.LocalSubnets = n.config.LocalSubnets
+	}
+	n.config = &applied
+
+	return errors.Join(errs...)
+}
+
+// setAddresses adds and removes addresses on the TUN adapter so that it has
+// the given ones. Addresses that couldn't be added or removed are logged, and
+// are tried again by the next call.
+func (n *node) setAddresses(addresses []string) error {
+	added, removed := diffStrings(n.addresses, addresses)
+	var errs []error
+	if len(removed) > 0 {
+		failed, err := routes.RemoveAddresses(n.tun, n.logger, removed)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		n.addresses = slices.DeleteFunc(slices.Clone(n.addresses), func(addr string) bool {
+			return slices.Contains(removed, addr) && !slices.Contains(failed, addr)
+		})
+	}
+	if len(added) > 0 {
+		failed, err := routes.SetAddresses(n.tun, n.logger, added)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		n.addresses = slices.Clone(n.addresses)
+		for _, addr := range added {
+			if !slices.Contains(failed, addr) {
+				n.addresses = append(n.addresses, addr)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setsPrivateKey returns whether the configuration file sets the private key,
+// as otherwise a new one is generated each time that it is read.
+func setsPrivateKey(conf []byte) bool {
+	var options map[string]any
+	if err := hjson.Unmarshal(conf, &options); err != nil {
+		return true
+	}
+	_, key := options["PrivateKey"]
+	_, path := options["PrivateKeyPath"]
+	return key || path
+}
+
+// changedOptions returns the names of the top-level options that differ
+// between the two configurations.
+func changedOptions(current, next *yggcfg.NodeConfig) ([]string, error) {
+	options := func(cfg *yggcfg.NodeConfig) (map[string]json.RawMessage, error) {
+		bs, err := json.Marshal(cfg)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]json.RawMessage
+		return m, json.Unmarshal(bs, &m)
+	}
+	a, err := options(current)
+	if err != nil {
+		return nil, err
+	}
+	b, err := options(next)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for name, value := range b {
+		if !bytes.Equal(a[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// diffStrings returns the strings that are in next but not in current, and
+// those that are in current but not in next.
+func diffStrings(current, next []string) (added, removed []string) {
+	for _, s := range next {
+		if !slices.Contains(current, s) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range current {
+		if !slices.Contains(next, s) {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+// systemRoutes allows the CKR module to add and remove routes on the TUN
+// adapter when routes are changed at runtime.
+type systemRoutes struct {
+	tun *tun.TunAdapter
+	log *log.Logger
+}
+
+func (r *systemRoutes) AddRoute(cidr string) error {
+	return routes.AddRoute(r.tun, r.log, cidr)
+}
+
+func (r *systemRoutes) RemoveRoute(cidr string) error {
+	return routes.RemoveRoute(r.tun, r.log, cidr)
+}
+
 func setLogLevel(loglevel string, logger *log.Logger) {
 	levels := [...]string{"error", "warn", "info", "debug", "trace"}
 	loglevel = strings.ToLower(loglevel)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	yggcfg "github.com/yggdrasil-network/yggdrasil-go/src/config"
+)
+
+func TestChangedOptions(t *testing.T) {
+	base := func() *yggcfg.NodeConfig {
+		return &yggcfg.NodeConfig{
+			PrivateKey: yggcfg.KeyBytes{1, 2, 3},
+			Peers:      []string{"tls://192.0.2.1:443"},
+			IfName:     "auto",
+		}
+	}
+	for _, test := range []struct {
+		name   string
+		change func(*yggcfg.NodeConfig)
+		want   []string
+	}{
+		{"unchanged", func(*yggcfg.NodeConfig) {}, nil},
+		{"private key", func(c *yggcfg.NodeConfig) { c.PrivateKey = yggcfg.KeyBytes{4, 5, 6} }, []string{"PrivateKey"}},
+		{"several", func(c *yggcfg.NodeConfig) { c.Peers, c.IfMTU, c.IfName = nil, 1280, "ygg0" }, []string{"IfMTU", "IfName", "Peers"}},
+		{"added peer", func(c *yggcfg.NodeConfig) { c.Peers = append(c.Peers, "tls://192.0.2.2:443") }, []string{"Peers"}},
+	} {
+		next := base()
+		test.change(next)
+		changed, err := changedOptions(base(), next)
+		if err != nil {
+			t.Fatalf("%s: changedOptions: %v", test.name, err)
+		}
+		if !slices.Equal(changed, test.want) {
+			t.Fatalf("%s: changedOptions = %v, want %v", test.name, changed, test.want)
+		}
+	}
+}
+
+func TestDiffStrings(t *testing.T) {
+	for _, test := range []struct {
+		current, next, added, removed []string
+	}{
+		{nil, nil, nil, nil},
+		{nil, []string{"10.0.0.1/24"}, []string{"10.0.0.1/24"}, nil},
+		{[]string{"10.0.0.1/24"}, nil, nil, []string{"10.0.0.1/24"}},
+		{[]string{"10.0.0.1/24", "fd00::1/64"}, []string{"fd00::1/64", "10.0.0.1/24"}, nil, nil},
+		{[]string{"10.0.0.1/24", "fd00::1/64"}, []string{"10.0.0.2/24", "fd00::1/64"}, []string{"10.0.0.2/24"}, []string{"10.0.0.1/24"}},
+	} {
+		added, removed := diffStrings(test.current, test.next)
+		if !slices.Equal(added, test.added) || !slices.Equal(removed, test.removed) {
+			t.Fatalf("diffStrings(%v, %v) = %v, %v, want %v, %v", test.current, test.next, added, removed, test.added, test.removed)
+		}
+	}
+}
+
+func TestSetsPrivateKey(t *testing.T) {
+	for conf, want := range map[string]bool{
+		`{ PrivateKey: "abcd", Peers: [] }`:            true,
+		`{ PrivateKeyPath: "/etc/ygg.key" }`:           true,
+		`{ Peers: [], TunnelRouting: { Routes: [] } }`: false,
+		`{ TunnelRouting: { PrivateKey: "abcd" } }`:    false,
+	} {
+		if got := setsPrivateKey([]byte(conf)); got != want {
+			t.Fatalf("setsPrivateKey(%s) = %v, want %v", conf, got, want)
+		}
+	}
+}
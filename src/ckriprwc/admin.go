@@ -0,0 +1,440 @@
+package ckriprwc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type AddRemoteSubnetRequest struct {
+	Subnet   string `json:"subnet"`
+	Source   string `json:"source,omitempty"`
+	Key      string `json:"key"`
+	Priority int    `json:"priority,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+}
+
+type AddRemoteSubnetResponse struct{}
+
+type RemoveRemoteSubnetRequest struct {
+	Subnet string `json:"subnet"`
+	Source string `json:"source,omitempty"`
+	Key    string `json:"key,omitempty"`
+}
+
+type RemoveRemoteSubnetResponse struct{}
+
+type ReplaceRemoteSubnetRequest struct {
+	Subnet string `json:"subnet"`
+	Source string `json:"source,omitempty"`
+	Key    string `json:"key"`
+}
+
+type ReplaceRemoteSubnetResponse struct{}
+
+type ImportRemoteSubnetsRequest struct {
+	Key   string `json:"key"`
+	Apply bool   `json:"apply,omitempty"`
+}
+
+type ImportRemoteSubnetsResponse struct {
+	RemoteSubnets map[string][]string `json:"remote_subnets"`
+	Applied       bool                `json:"applied"`
+}
+
+type GetRemoteSubnetsRequest struct{}
+
+type GetRemoteSubnetsResponse struct {
+	IPv4 []RemoteSubnetEntry `json:"ipv4"`
+	IPv6 []RemoteSubnetEntry `json:"ipv6"`
+}
+
+type RemoteSubnetEntry struct {
+	Subnet       string                    `json:"subnet"`
+	Source       string                    `json:"source,omitempty"`
+	Type         string                    `json:"type,omitempty"`
+	Destinations []RemoteSubnetDestination `json:"destinations"`
+	Rules        int                       `json:"rules,omitempty"`
+	Stateful     bool                      `json:"stateful,omitempty"`
+	RemoteSubnet string                    `json:"remote_subnet,omitempty"`
+	RPF          string                    `json:"reverse_path_filter,omitempty"`
+}
+
+type RemoteSubnetDestination struct {
+	Key       string  `json:"key"`
+	Priority  int     `json:"priority"`
+	Weight    int     `json:"weight"`
+	Reachable bool    `json:"reachable"`
+	Learned   bool    `json:"learned,omitempty"`
+	Expires   float64 `json:"expires,omitempty"`
+}
+
+type GetCKRSessionsRequest struct{}
+
+type GetCKRSessionsResponse struct {
+	Sessions []CKRSessionEntry `json:"sessions"`
+	Pending  []CKRPendingEntry `json:"pending"`
+}
+
+type CKRSessionEntry struct {
+	Key      string  `json:"key"`
+	Address  string  `json:"address"`
+	Subnet   string  `json:"subnet"`
+	LastSeen float64 `json:"last_seen"`
+	Expires  float64 `json:"expires"`
+}
+
+type CKRPendingEntry struct {
+	Destination string  `json:"destination"`
+	Packets     int     `json:"packets"`
+	Bytes       int     `json:"bytes"`
+	Expires     float64 `json:"expires"`
+}
+
+func (rwc *ReadWriteCloser) importRemoteSubnetsHandler(req *ImportRemoteSubnetsRequest, res *ImportRemoteSubnetsResponse) error {
+	subnets, err := rwc.ImportRemoteSubnets(req.Key, req.Apply)
+	if subnets == nil {
+		subnets = []string{}
+	}
+	res.RemoteSubnets = map[string][]string{req.Key: subnets}
+	res.Applied = req.Apply
+	return err
+}
+
+func (rwc *ReadWriteCloser) getRemoteSubnetsHandler(req *GetRemoteSubnetsRequest, res *GetRemoteSubnetsResponse) error {
+	v4, v6 := rwc.ckr.getRoutes()
+	res.IPv4 = remoteSubnetEntries(v4)
+	res.IPv6 = remoteSubnetEntries(v6)
+	return nil
+}
+
+func remoteSubnetEntries(routes []route) []RemoteSubnetEntry {
+	now := time.Now()
+	entries := make([]RemoteSubnetEntry, 0, len(routes))
+	for _, r := range routes {
+		entry := RemoteSubnetEntry{
+			Subnet:       r.prefix.String(),
+			Destinations: make([]RemoteSubnetDestination, 0, len(r.destinations)),
+			Rules:        len(r.rules),
+			Stateful:     r.stateful,
+		}
+		if r.remote.IsValid() {
+			entry.RemoteSubnet = r.remote.String()
+		}
+		if r.rpf != rpfDefault {
+			entry.RPF = r.rpf.String()
+		}
+		if r.source.IsValid() {
+			entry.Source = r.source.String()
+		}
+		if r.typ != routeForward {
+			entry.Type = r.typ.String()
+		}
+		for _, d := range r.destinations {
+			down, _ := d.state.isDown(now)
+			dest := RemoteSubnetDestination{
+				Key:       hex.EncodeToString(d.key),
+				Priority:  d.priority,
+				Weight:    d.weight,
+				Reachable: !down,
+				Learned:   d.learned,
+			}
+			if d.learned {
+				dest.Expires = time.Unix(0, d.expires.Load()).Sub(now).Seconds()
+			}
+			entry.Destinations = append(entry.Destinations, dest)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (rwc *ReadWriteCloser) getCKRSessionsHandler(req *GetCKRSessionsRequest, res *GetCKRSessionsResponse) error {
+	now := time.Now()
+	res.Sessions = []CKRSessionEntry{}
+	res.Pending = []CKRPendingEntry{}
+	rwc.mutex.Lock()
+	for _, info := range rwc.keyToInfo.all() {
+		lastSeen := time.Unix(0, info.lastSeen.Load())
+		res.Sessions = append(res.Sessions, CKRSessionEntry{
+			Key:      hex.EncodeToString(info.key[:]),
+			Address:  net.IP(info.address[:]).String(),
+			Subnet:   subnetString(info.subnet),
+			LastSeen: now.Sub(lastSeen).Seconds(),
+			Expires:  lastSeen.Add(rwc.keyTTL).Sub(now).Seconds(),
+		})
+	}
+	for addr, buf := range rwc.addrBuffer {
+		res.Pending = append(res.Pending, CKRPendingEntry{
+			Destination: net.IP(addr[:]).String(),
+			Packets:     len(buf.packets),
+			Bytes:       buf.bytes,
+			Expires:     buf.created.Add(rwc.pendingTTL).Sub(now).Seconds(),
+		})
+	}
+	for subnet, buf := range rwc.subnetBuffer {
+		res.Pending = append(res.Pending, CKRPendingEntry{
+			Destination: subnetString(subnet),
+			Packets:     len(buf.packets),
+			Bytes:       buf.bytes,
+			Expires:     buf.created.Add(rwc.pendingTTL).Sub(now).Seconds(),
+		})
+	}
+	rwc.mutex.Unlock()
+	sort.Slice(res.Sessions, func(i, j int) bool {
+		return res.Sessions[i].Key < res.Sessions[j].Key
+	})
+	sort.Slice(res.Pending, func(i, j int) bool {
+		return pendingAddr(res.Pending[i].Destination).Less(pendingAddr(res.Pending[j].Destination))
+	})
+	return nil
+}
+
+// Returns the address of a pending destination, which is either an address or
+// a subnet.
+func pendingAddr(destination string) netip.Addr {
+	if prefix, err := netip.ParsePrefix(destination); err == nil {
+		return prefix.Addr()
+	}
+	addr, _ := netip.ParseAddr(destination)
+	return addr
+}
+
+type GetCKRDestinationsRequest struct{}
+
+type GetCKRDestinationsResponse struct {
+	Destinations []CKRDestinationEntry `json:"destinations"`
+}
+
+type CKRDestinationEntry struct {
+	Key          string  `json:"key"`
+	Reachable    bool    `json:"reachable"`
+	RTT          float64 `json:"rtt,omitempty"`
+	LastReply    float64 `json:"last_reply,omitempty"`
+	MissedProbes int     `json:"missed_probes"`
+}
+
+func (rwc *ReadWriteCloser) getCKRDestinationsHandler(req *GetCKRDestinationsRequest, res *GetCKRDestinationsResponse) error {
+	now := time.Now()
+	res.Destinations = []CKRDestinationEntry{}
+	for _, info := range rwc.GetDestinations() {
+		entry := CKRDestinationEntry{
+			Key:          hex.EncodeToString(info.Key),
+			Reachable:    info.Reachable,
+			RTT:          info.RTT.Seconds(),
+			MissedProbes: info.MissedProbes,
+		}
+		if !info.LastProbeReply.IsZero() {
+			entry.LastReply = now.Sub(info.LastProbeReply).Seconds()
+		}
+		res.Destinations = append(res.Destinations, entry)
+	}
+	return nil
+}
+
+type GetCKRStatsRequest struct{}
+
+type GetCKRStatsResponse struct {
+	Rejected       map[string]uint64 `json:"rejected"`
+	ICMPSuppressed uint64            `json:"icmp_suppressed"`
+	PendingDropped uint64            `json:"pending_dropped"`
+}
+
+func (rwc *ReadWriteCloser) getCKRStatsHandler(req *GetCKRStatsRequest, res *GetCKRStatsResponse) error {
+	res.Rejected = rwc.GetRejectedPackets()
+	res.ICMPSuppressed = rwc.GetSuppressedICMPErrors()
+	res.PendingDropped = rwc.GetDroppedPending()
+	return nil
+}
+
+type GetCKRFlowsRequest struct{}
+
+type GetCKRFlowsResponse struct {
+	Flows []CKRFlowEntry `json:"flows"`
+}
+
+type CKRFlowEntry struct {
+	Protocol   int     `json:"protocol"`
+	Local      string  `json:"local"`
+	Remote     string  `json:"remote"`
+	State      string  `json:"state"`
+	Age        float64 `json:"age"`
+	LastSeen   float64 `json:"last_seen"`
+	Expires    float64 `json:"expires"`
+	PacketsOut uint64  `json:"packets_out"`
+	PacketsIn  uint64  `json:"packets_in"`
+}
+
+func (rwc *ReadWriteCloser) getCKRFlowsHandler(req *GetCKRFlowsRequest, res *GetCKRFlowsResponse) error {
+	now := time.Now()
+	res.Flows = []CKRFlowEntry{}
+	for _, info := range rwc.GetFlows() {
+		res.Flows = append(res.Flows, CKRFlowEntry{
+			Protocol:   info.Protocol,
+			Local:      info.Local.String(),
+			Remote:     info.Remote.String(),
+			State:      info.State,
+			Age:        now.Sub(info.Created).Seconds(),
+			LastSeen:   now.Sub(info.LastSeen).Seconds(),
+			Expires:    info.Expires.Sub(now).Seconds(),
+			PacketsOut: info.PacketsOut,
+			PacketsIn:  info.PacketsIn,
+		})
+	}
+	return nil
+}
+
+func subnetString(subnet address.Subnet) string {
+	ipnet := net.IPNet{
+		IP:   append(subnet[:], 0, 0, 0, 0, 0, 0, 0, 0),
+		Mask: net.CIDRMask(len(subnet)*8, 128),
+	}
+	return ipnet.String()
+}
+
+func (rwc *ReadWriteCloser) addRemoteSubnetHandler(req *AddRemoteSubnetRequest, res *AddRemoteSubnetResponse) error {
+	return rwc.AddRemoteSubnet(req.Subnet, req.Source, req.Key, req.Priority, req.Weight)
+}
+
+func (rwc *ReadWriteCloser) removeRemoteSubnetHandler(req *RemoveRemoteSubnetRequest, res *RemoveRemoteSubnetResponse) error {
+	return rwc.RemoveRemoteSubnet(req.Subnet, req.Source, req.Key)
+}
+
+func (rwc *ReadWriteCloser) replaceRemoteSubnetHandler(req *ReplaceRemoteSubnetRequest, res *ReplaceRemoteSubnetResponse) error {
+	return rwc.ReplaceRemoteSubnet(req.Subnet, req.Source, req.Key)
+}
+
+func (rwc *ReadWriteCloser) SetupAdminHandlers(a *admin.AdminSocket) {
+	_ = a.AddHandler(
+		"getRemoteSubnets", "Show the active crypto-key routes", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetRemoteSubnetsRequest{}
+			res := &GetRemoteSubnetsResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.getRemoteSubnetsHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getCKRSessions", "Show the cached crypto-key sessions and pending packets", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetCKRSessionsRequest{}
+			res := &GetCKRSessionsResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.getCKRSessionsHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"importRemoteSubnets", "Fetch the subnets published in a remote node's NodeInfo, and optionally route them via that node", []string{"key", "[apply]"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &ImportRemoteSubnetsRequest{}
+			res := &ImportRemoteSubnetsResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.importRemoteSubnetsHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getCKRDestinations", "Show the reachability of the remote nodes used by crypto-key routes", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetCKRDestinationsRequest{}
+			res := &GetCKRDestinationsResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.getCKRDestinationsHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getCKRStats", "Show counters for crypto-key routed traffic", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetCKRStatsRequest{}
+			res := &GetCKRStatsResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.getCKRStatsHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getCKRFlows", "Show the flows tracked for stateful crypto-key routes", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetCKRFlowsRequest{}
+			res := &GetCKRFlowsResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.getCKRFlowsHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"addRemoteSubnet", "Add a crypto-key route for a subnet via a remote node", []string{"subnet", "key", "[source]", "[priority]", "[weight]"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &AddRemoteSubnetRequest{}
+			res := &AddRemoteSubnetResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.addRemoteSubnetHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"removeRemoteSubnet", "Remove the crypto-key route for a subnet", []string{"subnet", "[source]", "[key]"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &RemoveRemoteSubnetRequest{}
+			res := &RemoveRemoteSubnetResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.removeRemoteSubnetHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"replaceRemoteSubnet", "Point the crypto-key route for a subnet at only the given remote node", []string{"subnet", "key", "[source]"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &ReplaceRemoteSubnetRequest{}
+			res := &ReplaceRemoteSubnetResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.replaceRemoteSubnetHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+}
@@ -0,0 +1,209 @@
+package ckriprwc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/yggdrasilckr/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+// Checks that the response marshals to the same JSON as want, ignoring
+// formatting and the order of object keys.
+func expectJSON(t *testing.T, res any, want string) {
+	t.Helper()
+	bs, err := json.Marshal(res)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	var got, expected any
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if err := json.Unmarshal([]byte(want), &expected); err != nil {
+		t.Fatalf("bad expected JSON: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("response is %s, want %s", bs, want)
+	}
+}
+
+// Checks that a number of seconds relative to now is about what is expected,
+// and zeroes it so that the rest of the response can be compared.
+func expectSeconds(t *testing.T, got *float64, want float64) {
+	t.Helper()
+	if math.Abs(*got-want) > 1 {
+		t.Fatalf("got %f seconds, want %f", *got, want)
+	}
+	*got = 0
+}
+
+func TestGetRemoteSubnetsHandler(t *testing.T) {
+	rwc := testReadWriteCloser()
+	_ = rwc.ckr.configure(&config.TunnelRoutingConfig{
+		Routes: []config.RouteConfig{
+			{Subnet: "10.0.0.0/8", Destinations: []config.RouteDestinationConfig{{Key: testKey(0), Weight: 2}, {Key: testKey(1), Priority: 1}}},
+			{Subnet: "172.16.0.0/12", Source: "10.1.0.0/16", Destinations: []config.RouteDestinationConfig{{Key: testKey(0)}}, Rules: []config.RuleConfig{{Action: "allow", Protocol: "tcp"}}},
+			{Subnet: "192.168.1.0/24", Alias: "10.200.6.0/24", Destinations: []config.RouteDestinationConfig{{Key: testKey(1)}}, Stateful: true, ReversePathFilter: "loose"},
+			{Subnet: "fd00::/8", Type: "blackhole"},
+		},
+	})
+	rwc.ckr.getKeyState(testPublicKey(1)).down.Store(true)
+	res := &GetRemoteSubnetsResponse{}
+	if err := rwc.getRemoteSubnetsHandler(&GetRemoteSubnetsRequest{}, res); err != nil {
+		t.Fatalf("getRemoteSubnetsHandler: %v", err)
+	}
+	expectJSON(t, res, `{
+		"ipv4": [
+			{"subnet": "10.200.6.0/24", "remote_subnet": "192.168.1.0/24", "stateful": true, "reverse_path_filter": "loose", "destinations": [
+				{"key": "`+testKey(1)+`", "priority": 0, "weight": 1, "reachable": false}
+			]},
+			{"subnet": "172.16.0.0/12", "source": "10.1.0.0/16", "rules": 1, "destinations": [
+				{"key": "`+testKey(0)+`", "priority": 0, "weight": 1, "reachable": true}
+			]},
+			{"subnet": "10.0.0.0/8", "destinations": [
+				{"key": "`+testKey(0)+`", "priority": 0, "weight": 2, "reachable": true},
+				{"key": "`+testKey(1)+`", "priority": 1, "weight": 1, "reachable": false}
+			]}
+		],
+		"ipv6": [
+			{"subnet": "fd00::/8", "type": "blackhole", "destinations": []}
+		]
+	}`)
+}
+
+func TestGetCKRSessionsHandler(t *testing.T) {
+	rwc := testReadWriteCloser()
+	now := time.Now()
+	rwc.mutex.Lock()
+	for i, seen := range []time.Duration{10 * time.Second, time.Minute} {
+		info := &keyInfo{key: keyArray{byte(i + 1)}, address: address.Address{0x02, byte(i + 1)}, subnet: address.Subnet{0x03, byte(i + 1)}}
+		info.lastSeen.Store(now.Add(-seen).UnixNano())
+		rwc._addKey(info)
+	}
+	subnet := &buffer{subnet: address.Subnet{0x03, 9}}
+	rwc._addBuffer(subnet)
+	rwc._enqueue(subnet, testTCPPacket("10.1.2.3", "10.9.9.9", 40000, 22, 0x02))
+	addr := &buffer{address: address.Address{0x02, 9}}
+	rwc._addBuffer(addr)
+	rwc._enqueue(addr, testTCPPacket("200::1", "209::1", 40000, 22, 0x02))
+	rwc._enqueue(addr, testTCPPacket("200::1", "209::1", 40001, 22, 0x02))
+	rwc.mutex.Unlock()
+
+	res := &GetCKRSessionsResponse{}
+	if err := rwc.getCKRSessionsHandler(&GetCKRSessionsRequest{}, res); err != nil {
+		t.Fatalf("getCKRSessionsHandler: %v", err)
+	}
+	if len(res.Sessions) != 2 || len(res.Pending) != 2 {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	ttl := keyStoreDefaultKeyTTL.Seconds()
+	expectSeconds(t, &res.Sessions[0].LastSeen, 10)
+	expectSeconds(t, &res.Sessions[0].Expires, ttl-10)
+	expectSeconds(t, &res.Sessions[1].LastSeen, 60)
+	expectSeconds(t, &res.Sessions[1].Expires, ttl-60)
+	for i := range res.Pending {
+		expectSeconds(t, &res.Pending[i].Expires, keyStoreDefaultPendingTTL.Seconds())
+	}
+	key := func(i byte) string {
+		k := keyArray{i}
+		return hex.EncodeToString(k[:])
+	}
+	expectJSON(t, res, `{
+		"sessions": [
+			{"key": "`+key(1)+`", "address": "201::", "subnet": "301::/64", "last_seen": 0, "expires": 0},
+			{"key": "`+key(2)+`", "address": "202::", "subnet": "302::/64", "last_seen": 0, "expires": 0}
+		],
+		"pending": [
+			{"destination": "209::", "packets": 2, "bytes": 120, "expires": 0},
+			{"destination": "309::/64", "packets": 1, "bytes": 40, "expires": 0}
+		]
+	}`)
+}
+
+func TestGetCKRDestinationsHandler(t *testing.T) {
+	rwc := testReadWriteCloser()
+	_ = rwc.ckr.configure(&config.TunnelRoutingConfig{
+		RemoteSubnets: map[string][]string{
+			testKey(0): {"10.0.0.0/8"},
+			testKey(1): {"172.16.0.0/12", "fd00::/8"},
+		},
+	})
+	answered := rwc.ckr.getKeyState(testPublicKey(0))
+	answered.probe.rtt.Store(int64(5 * time.Millisecond))
+	answered.probe.lastReply.Store(time.Now().Add(-2 * time.Second).UnixNano())
+	failed := rwc.ckr.getKeyState(testPublicKey(1))
+	failed.probe.missed.Store(probeLossThreshold)
+	failed.down.Store(true)
+
+	res := &GetCKRDestinationsResponse{}
+	if err := rwc.getCKRDestinationsHandler(&GetCKRDestinationsRequest{}, res); err != nil {
+		t.Fatalf("getCKRDestinationsHandler: %v", err)
+	}
+	if len(res.Destinations) != 2 {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	expectSeconds(t, &res.Destinations[0].LastReply, 2)
+	expectJSON(t, res, `{
+		"destinations": [
+			{"key": "`+testKey(0)+`", "reachable": true, "rtt": 0.005, "missed_probes": 0},
+			{"key": "`+testKey(1)+`", "reachable": false, "missed_probes": 3}
+		]
+	}`)
+}
+
+func TestGetCKRStatsHandler(t *testing.T) {
+	rwc := testReadWriteCloser()
+	rwc.ckr.rejected.add(rejectWrongKey)
+	rwc.ckr.rejected.add(rejectWrongKey)
+	rwc.ckr.rejected.add(rejectFirewall)
+	rwc.ckr.icmp.suppressed.Add(3)
+	rwc.dropped.Add(4)
+
+	res := &GetCKRStatsResponse{}
+	if err := rwc.getCKRStatsHandler(&GetCKRStatsRequest{}, res); err != nil {
+		t.Fatalf("getCKRStatsHandler: %v", err)
+	}
+	expectJSON(t, res, `{
+		"rejected": {
+			"no_route": 0, "wrong_key": 2, "unknown_key": 0, "denied": 0, "yggdrasil_routing": 0,
+			"oversize": 0, "translation": 0, "masquerade": 0, "firewall": 1
+		},
+		"icmp_suppressed": 3,
+		"pending_dropped": 4
+	}`)
+}
+
+func TestGetCKRFlowsHandler(t *testing.T) {
+	rwc := testReadWriteCloser()
+	_ = rwc.ckr.configure(&config.TunnelRoutingConfig{
+		Routes: []config.RouteConfig{{
+			Subnet:       "172.16.0.0/12",
+			Destinations: []config.RouteDestinationConfig{{Key: testKey(0)}},
+			Stateful:     true,
+		}},
+	})
+	if _, err := rwc.writePC(testTCPPacket("10.1.2.3", "172.16.0.5", 40000, 443, 0x02)); err != nil {
+		t.Fatalf("writePC: %v", err)
+	}
+
+	res := &GetCKRFlowsResponse{}
+	if err := rwc.getCKRFlowsHandler(&GetCKRFlowsRequest{}, res); err != nil {
+		t.Fatalf("getCKRFlowsHandler: %v", err)
+	}
+	if len(res.Flows) != 1 {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	expectSeconds(t, &res.Flows[0].Age, 0)
+	expectSeconds(t, &res.Flows[0].LastSeen, 0)
+	expectSeconds(t, &res.Flows[0].Expires, conntrackTCPSynSentTimeout.Seconds())
+	expectJSON(t, res, `{
+		"flows": [
+			{"protocol": 6, "local": "10.1.2.3:40000", "remote": "172.16.0.5:443", "state": "new", "age": 0, "last_seen": 0, "expires": 0, "packets_out": 1, "packets_in": 0}
+		]
+	}`)
+}
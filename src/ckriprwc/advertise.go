@@ -0,0 +1,357 @@
+package ckriprwc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"time"
+
+	iwt "github.com/Arceliar/ironwood/types"
+
+	"github.com/neilalexander/yggdrasilckr/src/config"
+)
+
+// Nodes can advertise the subnets that are reachable through them to the
+// nodes listed in AdvertisementPeers. An advertisement is a control message
+// listing the subnets, each encoded as its prefix length, address family and
+// address. Subnets advertised by a listed node are routed to it until it
+// stops advertising them, unless a route for the same subnet is configured,
+// in which case the configured route always wins. A node can only advertise
+// subnets within its AdvertisementPrefixes, if it has any. Otherwise it can
+// only advertise subnets at least as long as the minimum prefix lengths
+// below, so that it can't take over the default route, even by splitting it
+// into several shorter prefixes.
+
+// How often the local subnets are advertised to each peer.
+const advertisementInterval = 30 * time.Second
+
+// How long a learned route lasts without being advertised again.
+const advertisementHoldTime = 3 * advertisementInterval
+
+// Advertisements are split so that each message is no larger than this.
+const advertisementMaxSize = 1024
+
+// The shortest prefixes that nodes without AdvertisementPrefixes can
+// advertise.
+const (
+	advertisementMinBits4 = 8
+	advertisementMinBits6 = 16
+)
+
+func (k *keyStore) advertiser() {
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-timer.C:
+		}
+		peers, subnets := k.ckr.getAdvertisementConfig()
+		if len(subnets) > 0 {
+			msgs := encodeAdvertisement(subnets)
+			for _, peer := range peers {
+				for _, msg := range msgs {
+					_, _ = k.conn.WriteTo(msg, iwt.Addr(peer))
+				}
+			}
+		}
+		for _, subnet := range k.ckr.expireLearnedRoutes(time.Now()) {
+			_ = k.removeSystemRoute(subnet)
+		}
+		timer.Reset(advertisementInterval)
+	}
+}
+
+func (k *keyStore) handleAdvertisement(bs []byte, from ed25519.PublicKey) {
+	prefixes, ok := decodeAdvertisement(bs)
+	if !ok {
+		return
+	}
+	expires := time.Now().Add(advertisementHoldTime)
+	for _, subnet := range k.ckr.learnRoutes(from, prefixes, expires) {
+		_ = k.addSystemRoute(subnet)
+	}
+}
+
+// Encodes the given subnets into one or more advertisement messages.
+func encodeAdvertisement(subnets []netip.Prefix) [][]byte {
+	var msgs [][]byte
+	msg := []byte{controlAdvertisement}
+	for _, subnet := range subnets {
+		addr := subnet.Addr().AsSlice()
+		if len(msg)+2+len(addr) > advertisementMaxSize {
+			msgs = append(msgs, msg)
+			msg = []byte{controlAdvertisement}
+		}
+		family := byte(6)
+		if subnet.Addr().Is4() {
+			family = 4
+		}
+		msg = append(msg, byte(subnet.Bits()), family)
+		msg = append(msg, addr...)
+	}
+	return append(msgs, msg)
+}
+
+// Decodes the subnets from an advertisement message. Returns false if the
+// message is malformed.
+func decodeAdvertisement(bs []byte) ([]netip.Prefix, bool) {
+	var prefixes []netip.Prefix
+	bs = bs[1:]
+	for len(bs) > 0 {
+		if len(bs) < 2 {
+			return nil, false
+		}
+		bits, family := int(bs[0]), bs[1]
+		bs = bs[2:]
+		var size int
+		switch family {
+		case 4:
+			size = 4
+		case 6:
+			size = 16
+		default:
+			return nil, false
+		}
+		if len(bs) < size {
+			return nil, false
+		}
+		addr, _ := netip.AddrFromSlice(bs[:size])
+		bs = bs[size:]
+		prefix, err := addr.Prefix(bits)
+		if err != nil || prefix.Bits() != bits {
+			return nil, false
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, true
+}
+
+// Returns errors for any entries in LocalSubnets, AdvertisementPeers or
+// AdvertisementPrefixes that are not valid.
+func advertisementConfigErrors(config *config.TunnelRoutingConfig) []error {
+	var errs []error
+	for _, cidr := range config.LocalSubnets {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("local subnet %q: %w", cidr, err))
+		}
+	}
+	for _, peer := range config.AdvertisementPeers {
+		if key, err := hex.DecodeString(peer); err != nil || len(key) != ed25519.PublicKeySize {
+			errs = append(errs, fmt.Errorf("advertisement peer %q is not a valid public key", peer))
+		}
+	}
+	for peer, cidrs := range config.AdvertisementPrefixes {
+		if key, err := hex.DecodeString(peer); err != nil || len(key) != ed25519.PublicKeySize {
+			errs = append(errs, fmt.Errorf("advertisement prefixes key %q is not a valid public key", peer))
+		}
+		for _, cidr := range cidrs {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				errs = append(errs, fmt.Errorf("advertisement prefix %q for %s: %w", cidr, peer, err))
+			}
+		}
+	}
+	return errs
+}
+
+// Returns the keys of the nodes to exchange advertisements with and the local
+// subnets to advertise to them. Invalid entries are skipped, as they will
+// have been reported when the configuration was loaded.
+func (c *cryptokey) getAdvertisementConfig() (peers []ed25519.PublicKey, subnets []netip.Prefix) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.config == nil {
+		return nil, nil
+	}
+	for _, peer := range c.config.AdvertisementPeers {
+		if key, err := hex.DecodeString(peer); err == nil && len(key) == ed25519.PublicKeySize {
+			peers = append(peers, key)
+		}
+	}
+	for _, cidr := range c.config.LocalSubnets {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			subnets = append(subnets, prefix.Masked())
+		}
+	}
+	return peers, subnets
+}
+
+// Returns whether routes advertised by the given key should be installed.
+// Read lock must be held.
+func (c *cryptokey) _isAdvertisementPeer(key ed25519.PublicKey) bool {
+	if c.config == nil {
+		return false
+	}
+	for _, peer := range c.config.AdvertisementPeers {
+		if bpk, err := hex.DecodeString(peer); err == nil && bytes.Equal(key, bpk) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the subnets that the given key may advertise, or nil if its
+// advertisements aren't limited to any. Invalid entries are skipped. Read lock
+// must be held.
+func (c *cryptokey) _advertisementPrefixes(key ed25519.PublicKey) []netip.Prefix {
+	var allowed []netip.Prefix
+	for peer, cidrs := range c.config.AdvertisementPrefixes {
+		if bpk, err := hex.DecodeString(peer); err != nil || !bytes.Equal(key, bpk) {
+			continue
+		}
+		if allowed == nil {
+			allowed = make([]netip.Prefix, 0, len(cidrs))
+		}
+		for _, cidr := range cidrs {
+			if prefix, err := netip.ParsePrefix(cidr); err == nil {
+				allowed = append(allowed, prefix.Masked())
+			}
+		}
+	}
+	return allowed
+}
+
+// Returns whether an advertised subnet falls within one of the allowed
+// subnets, or if there aren't any, whether it is at least as long as the
+// minimum prefix length.
+func advertisementAllowed(prefix netip.Prefix, allowed []netip.Prefix) bool {
+	if allowed == nil {
+		if prefix.Addr().Is4() {
+			return prefix.Bits() >= advertisementMinBits4
+		}
+		return prefix.Bits() >= advertisementMinBits6
+	}
+	for _, a := range allowed {
+		if a.Bits() <= prefix.Bits() && a.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Installs or refreshes the routes advertised by the given key, unless the
+// key isn't an advertisement peer. Subnets that already have a configured
+// route, that are served by this node, or that the key may not advertise are
+// ignored. Returns the subnets for which routes were created.
+func (c *cryptokey) learnRoutes(key ed25519.PublicKey, prefixes []netip.Prefix, expires time.Time) (added []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c._isAdvertisementPeer(key) {
+		return nil
+	}
+	allowed := c._advertisementPrefixes(key)
+	local := map[netip.Prefix]struct{}{}
+	for _, cidr := range c.config.LocalSubnets {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			local[prefix.Masked()] = struct{}{}
+		}
+	}
+
+	changed := false
+	for _, prefix := range prefixes {
+		if _, ok := local[prefix]; ok {
+			continue
+		}
+		if prefix.Addr().Is6() && isYggdrasilDestination(prefix.Addr()) {
+			continue
+		}
+		if !advertisementAllowed(prefix, allowed) {
+			c.log.Debugf("Ignoring remote subnet %s advertised by %s", prefix, hex.EncodeToString(key))
+			continue
+		}
+		var dests []*destination
+		learn := true
+		k := routeKey{prefix: prefix}
+		if r := c._getRoute(k); r != nil {
+			learn = r.typ == routeForward
+			for _, d := range r.destinations {
+				if !d.learned {
+					learn = false
+					break
+				}
+				if d.key.Equal(key) {
+					d.expires.Store(expires.UnixNano())
+					learn = false
+					break
+				}
+			}
+			dests = append(dests, r.destinations...)
+		}
+		if !learn {
+			continue
+		}
+		d := &destination{
+			key:     append(ed25519.PublicKey{}, key...),
+			learned: true,
+		}
+		d.expires.Store(expires.UnixNano())
+		if c._setRemoteSubnet(k, append(dests, d)) {
+			added = append(added, prefix.String())
+		}
+		c.log.Infof("Learned remote subnet %s via %s", prefix, hex.EncodeToString(key))
+		changed = true
+	}
+	if changed {
+		c._sortRoutes()
+		c._publish()
+	}
+	return added
+}
+
+// Removes learned destinations that have expired or whose key is no longer
+// an advertisement peer allowed to advertise the subnet. Returns the subnets
+// for which routes were removed because no destinations remain.
+func (c *cryptokey) expireLearnedRoutes(now time.Time) (removed []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	var empty []routeKey
+	changed := false
+	for _, routes := range [][]*route{c.v4Routes, c.v6Routes} {
+		for _, r := range routes {
+			dests := make([]*destination, 0, len(r.destinations))
+			for _, d := range r.destinations {
+				if d.learned && (d.expires.Load() <= now.UnixNano() || !c._isAdvertisementPeer(d.key) ||
+					!advertisementAllowed(r.prefix, c._advertisementPrefixes(d.key))) {
+					c.log.Infof("Learned remote subnet %s via %s has expired", r.prefix, hex.EncodeToString(d.key))
+					continue
+				}
+				dests = append(dests, d)
+			}
+			switch len(dests) {
+			case len(r.destinations):
+			case 0:
+				empty = append(empty, r.key())
+			default:
+				r.destinations = dests
+				changed = true
+			}
+		}
+	}
+	var v4, v6 bool
+	for _, k := range empty {
+		if c._removeRoute(k) {
+			removed = append(removed, k.prefix.String())
+		}
+		if k.prefix.Addr().Is6() {
+			v6 = true
+		} else {
+			v4 = true
+		}
+	}
+	if v4 {
+		c.v4Trie = newRouteTrie(c.v4Routes)
+	}
+	if v6 {
+		c.v6Trie = newRouteTrie(c.v6Routes)
+	}
+	if changed || len(empty) > 0 {
+		c._forgetKeyStates()
+		c._publish()
+	}
+	return removed
+}
@@ -2,6 +2,7 @@ package ckriprwc
 
 import (
 	"crypto/ed25519"
+	"errors"
 	"net"
 	"net/netip"
 	"sync"
@@ -19,239 +20,509 @@ import (
 	"github.com/yggdrasil-network/yggdrasil-go/src/core"
 )
 
-const keyStoreTimeout = 2 * time.Minute
+// Limits on the packets buffered while waiting for key lookups, for each
+// destination and across all of them. Packets beyond these are dropped.
+const (
+	pendingMaxPackets = 32
+	pendingMaxBytes   = 1 << 20
+)
 
 type keyArray [ed25519.PublicKeySize]byte
 
+// The parts of the Yggdrasil core that packets are sent and received through.
+// Tests replace it with a fake.
+type packetConn interface {
+	ReadFrom(p []byte) (n int, from net.Addr, err error)
+	WriteTo(p []byte, addr net.Addr) (n int, err error)
+	SendLookup(key ed25519.PublicKey)
+	MTU() uint64
+}
+
 type keyStore struct {
 	core         *core.Core
+	conn         packetConn // The core, for packets
 	ckr          cryptokey
 	address      address.Address
 	subnet       address.Subnet
-	mutex        sync.Mutex
-	keyToInfo    map[keyArray]*keyInfo
-	addrToInfo   map[address.Address]*keyInfo
+	keyToInfo    *shardedMap[keyArray, *keyInfo] // Read without the mutex
+	addrToInfo   *shardedMap[address.Address, *keyInfo]
+	subnetToInfo *shardedMap[address.Subnet, *keyInfo]
+	mutex        sync.Mutex // Serializes changes to the keys, and protects the below
+	expiries     keyExpiries
 	addrBuffer   map[address.Address]*buffer
-	subnetToInfo map[address.Subnet]*keyInfo
 	subnetBuffer map[address.Subnet]*buffer
+	buffersHead  *buffer // Least recently used list, most recent first
+	buffersTail  *buffer
+	keyTTL       time.Duration
+	pendingTTL   time.Duration
+	maxKeys      int
+	maxPending   int
+	pendingBytes int           // Total size of the buffered packets
+	dropped      atomic.Uint64 // Packets dropped because the buffers were full
 	mtu          atomic.Uint64
+	routes       RouteInstaller
+	getNodeInfo  core.AddHandlerFunc // The core's admin handler for fetching remote NodeInfo
+	buffers      sync.Pool
+	local        chan []byte   // Packets generated locally for the TUN adapter
+	incoming     chan received // Packets read from the network by the reader
+	readErr      error         // Why the reader stopped, set before incoming is closed
+	readOnce     sync.Once     // Starts the reader on the first read
+	warmup       chan struct{} // Wakes the path warmer
+	reprobe      chan struct{} // Wakes the prober
+	done         chan struct{}
+	closeOnce    sync.Once
 }
 
 type keyInfo struct {
-	key     keyArray
-	address address.Address
-	subnet  address.Subnet
-	timeout *time.Timer // From calling a time.AfterFunc to do cleanup
+	key      keyArray
+	address  address.Address
+	subnet   address.Subnet
+	lastSeen atomic.Int64 // Unix time in nanoseconds
+	due      int64        // Unix time in nanoseconds when the sweeper next checks the key, protected by the mutex
+	index    int          // In the key store's expiry heap, protected by the mutex
+}
+
+// A packet read from the network, in a buffer from the pool.
+type received struct {
+	buf  *[]byte
+	n    int
+	from net.Addr
 }
 
 type buffer struct {
-	packet  []byte
-	timeout *time.Timer
+	address    address.Address // Only one of the address and subnet is set
+	subnet     address.Subnet
+	packets    [][]byte // In the order they were sent
+	bytes      int
+	created    time.Time
+	prev, next *buffer
+}
+
+// Adds a copy of the packet to the end of the buffer, unless the buffer is
+// full or the packet would take the total size of all buffers over the limit,
+// in which case it is dropped. Mutex must be held.
+func (k *keyStore) _enqueue(buf *buffer, bs []byte) {
+	if len(buf.packets) >= pendingMaxPackets || k.pendingBytes+len(bs) > pendingMaxBytes {
+		k.dropped.Add(1)
+		return
+	}
+	buf.packets = append(buf.packets, append([]byte(nil), bs...))
+	buf.bytes += len(bs)
+	k.pendingBytes += len(bs)
+}
+
+// Takes the packets out of the buffer. Mutex must be held.
+func (k *keyStore) _dequeue(buf *buffer) [][]byte {
+	packets := buf.packets
+	k.pendingBytes -= buf.bytes
+	buf.packets, buf.bytes = nil, 0
+	return packets
 }
 
 func (k *keyStore) init(c *core.Core) {
 	k.core = c
+	k.conn = c
 	k.address = *address.AddrForKey(k.core.PublicKey())
 	k.subnet = *address.SubnetForKey(k.core.PublicKey())
 	k.core.SetPathNotify(func(key ed25519.PublicKey) {
 		k.update(key)
+		k.ckr.setReachable(key)
 	})
-	k.keyToInfo = make(map[keyArray]*keyInfo)
-	k.addrToInfo = make(map[address.Address]*keyInfo)
+	handlers := coreHandlers{}
+	if err := k.core.SetAdmin(handlers); err == nil {
+		k.getNodeInfo = handlers["getNodeInfo"]
+	}
+	k.keyToInfo = newShardedMap[keyArray, *keyInfo]()
+	k.addrToInfo = newShardedMap[address.Address, *keyInfo]()
 	k.addrBuffer = make(map[address.Address]*buffer)
-	k.subnetToInfo = make(map[address.Subnet]*keyInfo)
+	k.subnetToInfo = newShardedMap[address.Subnet, *keyInfo]()
 	k.subnetBuffer = make(map[address.Subnet]*buffer)
+	k.setLimits(nil)
 	k.mtu.Store(1280) // Default to something safe, expect user to set this
+	k.buffers.New = func() any {
+		buf := make([]byte, 65535)
+		return &buf
+	}
+	k.local = make(chan []byte, 16)
+	k.warmup = make(chan struct{}, 1)
+	k.reprobe = make(chan struct{}, 1)
+	k.done = make(chan struct{})
+}
+
+// Periodically looks up the paths to any CKR destinations that are considered
+// to be unreachable. If a path is found then the path notification will mark
+// the destination as reachable again, moving traffic back onto it.
+func (k *keyStore) failoverRecovery() {
+	ticker := time.NewTicker(failoverRecoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			for _, key := range k.ckr.getUnreachableKeys() {
+				k.sendKeyLookup(key)
+			}
+		}
+	}
 }
 
+// Periodically looks up the paths to all CKR destinations, if enabled, so that
+// they are already known when traffic is first sent to them and are kept
+// fresh while it is idle. The first lookups are sent straight away and again
+// whenever the configuration is reloaded, which is also the only thing that
+// wakes it while it is disabled.
+func (k *keyStore) pathWarmer() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-timer.C:
+		case <-k.warmup:
+			timer.Stop()
+		}
+		if interval := k.ckr.getPathWarmupInterval(); interval > 0 {
+			k.warmPaths()
+			timer.Reset(interval)
+		}
+	}
+}
+
+// Wakes the path warmer after the configuration has changed, so that paths to
+// any new destinations are looked up without waiting.
+func (k *keyStore) wakePathWarmer() {
+	select {
+	case k.warmup <- struct{}{}:
+	default:
+	}
+}
+
+// Looks up the paths to all CKR destinations.
+func (k *keyStore) warmPaths() {
+	for _, state := range k.ckr.getKeyStates() {
+		k.sendKeyLookup(state.key)
+	}
+}
+
+// Sends the packet to the node with the address if its key is known, which
+// doesn't need the mutex, or otherwise buffers it and looks the key up.
 func (k *keyStore) sendToAddress(addr address.Address, bs []byte) {
+	if info := k.addrToInfo.get(addr); info != nil {
+		info.seen(time.Now())
+		_, _ = k.conn.WriteTo(bs, iwt.Addr(info.key[:]))
+		return
+	}
 	k.mutex.Lock()
-	if info := k.addrToInfo[addr]; info != nil {
-		k.resetTimeout(info)
+	// The key may have arrived since it was looked up above.
+	if info := k.addrToInfo.get(addr); info != nil {
 		k.mutex.Unlock()
-		_, _ = k.core.WriteTo(bs, iwt.Addr(info.key[:]))
+		info.seen(time.Now())
+		_, _ = k.conn.WriteTo(bs, iwt.Addr(info.key[:]))
 	} else {
-		var buf *buffer
-		if buf = k.addrBuffer[addr]; buf == nil {
-			buf = new(buffer)
-			k.addrBuffer[addr] = buf
-		}
-		msg := append([]byte(nil), bs...)
-		buf.packet = msg
-		if buf.timeout != nil {
-			buf.timeout.Stop()
-		}
-		buf.timeout = time.AfterFunc(keyStoreTimeout, func() {
-			k.mutex.Lock()
-			defer k.mutex.Unlock()
-			if nbuf := k.addrBuffer[addr]; nbuf == buf {
-				delete(k.addrBuffer, addr)
-			}
-		})
+		buf := k.addrBuffer[addr]
+		if buf == nil {
+			buf = &buffer{address: addr}
+			k._addBuffer(buf)
+		}
+		k._touchBuffer(buf)
+		k._enqueue(buf, bs)
 		k.mutex.Unlock()
 		k.sendKeyLookup(addr.GetKey())
 	}
 }
 
+// Sends the packet to the node with the subnet, as sendToAddress does.
 func (k *keyStore) sendToSubnet(subnet address.Subnet, bs []byte) {
+	if info := k.subnetToInfo.get(subnet); info != nil {
+		info.seen(time.Now())
+		_, _ = k.conn.WriteTo(bs, iwt.Addr(info.key[:]))
+		return
+	}
 	k.mutex.Lock()
-	if info := k.subnetToInfo[subnet]; info != nil {
-		k.resetTimeout(info)
+	if info := k.subnetToInfo.get(subnet); info != nil {
 		k.mutex.Unlock()
-		_, _ = k.core.WriteTo(bs, iwt.Addr(info.key[:]))
+		info.seen(time.Now())
+		_, _ = k.conn.WriteTo(bs, iwt.Addr(info.key[:]))
 	} else {
-		var buf *buffer
-		if buf = k.subnetBuffer[subnet]; buf == nil {
-			buf = new(buffer)
-			k.subnetBuffer[subnet] = buf
-		}
-		msg := append([]byte(nil), bs...)
-		buf.packet = msg
-		if buf.timeout != nil {
-			buf.timeout.Stop()
-		}
-		buf.timeout = time.AfterFunc(keyStoreTimeout, func() {
-			k.mutex.Lock()
-			defer k.mutex.Unlock()
-			if nbuf := k.subnetBuffer[subnet]; nbuf == buf {
-				delete(k.subnetBuffer, subnet)
-			}
-		})
+		buf := k.subnetBuffer[subnet]
+		if buf == nil {
+			buf = &buffer{subnet: subnet}
+			k._addBuffer(buf)
+		}
+		k._touchBuffer(buf)
+		k._enqueue(buf, bs)
 		k.mutex.Unlock()
 		k.sendKeyLookup(subnet.GetKey())
 	}
 }
 
+// Records that the key is in use, adding it to the store and sending any
+// packets that were buffered for it if it is new. Known keys don't need the
+// mutex.
 func (k *keyStore) update(key ed25519.PublicKey) *keyInfo {
-	k.mutex.Lock()
 	var kArray keyArray
 	copy(kArray[:], key)
+	if info := k.keyToInfo.get(kArray); info != nil {
+		info.seen(time.Now())
+		return info
+	}
+	k.mutex.Lock()
 	var info *keyInfo
 	var packets [][]byte
-	if info = k.keyToInfo[kArray]; info == nil {
+	if info = k.keyToInfo.get(kArray); info == nil {
 		info = new(keyInfo)
 		info.key = kArray
 		info.address = *address.AddrForKey(ed25519.PublicKey(info.key[:]))
 		info.subnet = *address.SubnetForKey(ed25519.PublicKey(info.key[:]))
-		k.keyToInfo[info.key] = info
-		k.addrToInfo[info.address] = info
-		k.subnetToInfo[info.subnet] = info
+		k._addKey(info)
 		if buf := k.addrBuffer[info.address]; buf != nil {
-			packets = append(packets, buf.packet)
-			delete(k.addrBuffer, info.address)
+			packets = append(packets, k._removeBuffer(buf)...)
 		}
 		if buf := k.subnetBuffer[info.subnet]; buf != nil {
-			packets = append(packets, buf.packet)
-			delete(k.subnetBuffer, info.subnet)
+			packets = append(packets, k._removeBuffer(buf)...)
 		}
 	}
-	k.resetTimeout(info)
+	info.seen(time.Now())
 	k.mutex.Unlock()
 	for _, packet := range packets {
-		_, _ = k.core.WriteTo(packet, iwt.Addr(info.key[:]))
+		_, _ = k.conn.WriteTo(packet, iwt.Addr(info.key[:]))
 	}
 	return info
 }
 
-func (k *keyStore) resetTimeout(info *keyInfo) {
-	if info.timeout != nil {
-		info.timeout.Stop()
+// Marks the key as used now, so that it isn't expired by the sweeper. The
+// time is only stored if it has moved on by keySeenResolution, so that
+// parallel callers using the same key don't keep writing to the same memory.
+func (info *keyInfo) seen(now time.Time) {
+	if t := now.UnixNano(); t-info.lastSeen.Load() >= int64(keySeenResolution) {
+		info.lastSeen.Store(t)
 	}
-	info.timeout = time.AfterFunc(keyStoreTimeout, func() {
-		k.mutex.Lock()
-		defer k.mutex.Unlock()
-		if nfo := k.keyToInfo[info.key]; nfo == info {
-			delete(k.keyToInfo, info.key)
-		}
-		if nfo := k.addrToInfo[info.address]; nfo == info {
-			delete(k.addrToInfo, info.address)
-		}
-		if nfo := k.subnetToInfo[info.subnet]; nfo == info {
-			delete(k.subnetToInfo, info.subnet)
-		}
-	})
 }
 
 func (k *keyStore) sendKeyLookup(partial ed25519.PublicKey) {
-	k.core.SendLookup(partial)
+	k.conn.SendLookup(partial)
+}
+
+// Queues a packet that was generated locally to be returned by the next read.
+// The packet is dropped if the queue is full.
+func (k *keyStore) sendLocal(packet []byte) {
+	select {
+	case k.local <- packet:
+	default:
+	}
 }
 
+// Returns whether an ICMP error can be sent about the packet, which is subject
+// to rate limits overall and for the source of the packet. Errors are never
+// sent about other ICMP errors. It is checked before the error is built, so
+// that errors that are suppressed during a flood cost nothing to build.
+func (k *keyStore) allowICMPError(bs []byte) bool {
+	f, ok := parsePacketFields(bs)
+	if ok && isICMPError(&f) {
+		return false
+	}
+	return k.ckr.icmp.allow(f.src, time.Now())
+}
+
+// Answers a packet that can't be delivered with an ICMP no route message,
+// subject to the rate limits.
+func (k *keyStore) sendNoRoute(bs []byte) {
+	var srcAddr, dstAddr address.Address
+	ip4 := len(bs) >= 20 && bs[0]&0xf0 == 0x40
+	switch {
+	case ip4:
+		copy(srcAddr[:], bs[12:16])
+		copy(dstAddr[:], bs[16:20])
+	case len(bs) >= 40 && bs[0]&0xf0 == 0x60:
+		copy(srcAddr[:], bs[8:24])
+		copy(dstAddr[:], bs[24:40])
+	default:
+		return
+	}
+	if k.allowICMPError(bs) {
+		if packet, ok := buildNoRouteResponse(bs, ip4, srcAddr, dstAddr); ok {
+			k.sendLocal(packet)
+		}
+	}
+}
+
+// Returns the next packet for the TUN adapter, which is either a packet that
+// was generated locally, such as an ICMP error in response to a packet that
+// could not be written, or a packet from the network. Local packets come first
+// if there are any, and otherwise both are waited for at once, so that a local
+// packet is returned straight away even if nothing is arriving from the
+// network. Packets from the network are read by a single
+// reader, but are checked on the caller's goroutine, so that concurrent
+// readers don't wait on each other for that.
 func (k *keyStore) readPC(p []byte) (int, error) {
-	var _buf [65535]byte
-	buf := _buf[:k.core.MTU()]
+	k.readOnce.Do(func() {
+		k.incoming = make(chan received)
+		go k.reader()
+	})
 	for {
-		n, from, err := k.core.ReadFrom(buf)
-		if err != nil {
-			return n, err
+		select {
+		case packet := <-k.local:
+			return copy(p, packet), nil
+		default:
+		}
+		select {
+		case packet := <-k.local:
+			return copy(p, packet), nil
+		case <-k.done:
+			return 0, net.ErrClosed
+		case r, ok := <-k.incoming:
+			if !ok {
+				return 0, k.readErr
+			}
+			bs := (*r.buf)[:r.n]
+			n, accepted := 0, r.n > 0 && k.accept(bs, r.from)
+			if accepted {
+				n = copy(p, bs)
+			}
+			k.buffers.Put(r.buf)
+			if accepted {
+				return n, nil
+			}
 		}
-		if n == 0 {
-			continue
+	}
+}
+
+// Reads packets from the network for readPC until the network fails or the
+// key store is closed. Packets are read into buffers that fit any packet, so
+// that packets that are too large are answered rather than truncated.
+func (k *keyStore) reader() {
+	for {
+		buf := k.buffers.Get().(*[]byte)
+		n, from, err := k.conn.ReadFrom((*buf)[:min(int(k.conn.MTU()), len(*buf))])
+		if err != nil {
+			k.buffers.Put(buf)
+			k.readErr = err
+			close(k.incoming)
+			return
 		}
-		bs := buf[:n]
-		if len(bs) == 0 {
-			continue
+		select {
+		case k.incoming <- received{buf, n, from}:
+		case <-k.done:
+			k.buffers.Put(buf)
+			return
 		}
-		ip4 := bs[0]&0xf0 == 0x40
-		ip6 := bs[0]&0xf0 == 0x60
-		switch {
-		case !ip4 && !ip6:
-			continue
-		case ip6 && len(bs) < 40:
-			continue
-		case ip4 && len(bs) < 20:
-			continue
-		}
-		if mtu := int(k.mtu.Load()); len(bs) > mtu {
+	}
+}
+
+// Checks a packet received from the network, handling it if it is a control
+// message, and returns true if it should be passed to the TUN adapter.
+func (k *keyStore) accept(bs []byte, from net.Addr) bool {
+	ip4 := bs[0]&0xf0 == 0x40
+	ip6 := bs[0]&0xf0 == 0x60
+	switch {
+	case !ip4 && !ip6:
+		k.handleControl(bs, ed25519.PublicKey(from.(iwt.Addr)))
+		return false
+	case ip6 && len(bs) < 40:
+		return false
+	case ip4 && len(bs) < 20:
+		return false
+	}
+	if mtu := int(k.mtu.Load()); len(bs) > mtu {
+		k.ckr.rejected.add(rejectOversize)
+		if k.allowICMPError(bs) {
 			if packet, ok := buildOversizeResponse(bs, mtu); ok {
 				_, _ = k.writePC(packet)
 			}
-			continue
 		}
-		var srcAddr, dstAddr address.Address
-		var srcSubnet, dstSubnet address.Subnet
-		var addrlen int
-		switch {
-		case ip4:
-			copy(srcAddr[:], bs[12:16])
-			addrlen = 4
-		case ip6:
-			copy(srcAddr[:], bs[8:])
-			copy(srcSubnet[:], bs[8:])
-			copy(dstAddr[:], bs[24:])
-			copy(dstSubnet[:], bs[24:])
-			addrlen = 16
-		}
-		srcKey := ed25519.PublicKey(from.(iwt.Addr))
-		info := k.update(srcKey)
-		switch {
-		case ip6 && (srcAddr == info.address || srcSubnet == info.subnet):
-			// Handling traffic from Yggdrasil sources.
-			if k.ckr.config.YggdrasilRouting {
-				return copy(p, bs), nil
+		return false
+	}
+	var srcAddr, dstAddr address.Address
+	var srcSubnet, dstSubnet address.Subnet
+	var addrlen int
+	switch {
+	case ip4:
+		copy(srcAddr[:], bs[12:16])
+		copy(dstAddr[:], bs[16:20])
+		addrlen = 4
+	case ip6:
+		copy(srcAddr[:], bs[8:])
+		copy(srcSubnet[:], bs[8:])
+		copy(dstAddr[:], bs[24:])
+		copy(dstSubnet[:], bs[24:])
+		addrlen = 16
+	}
+	srcKey := ed25519.PublicKey(from.(iwt.Addr))
+	info := k.update(srcKey)
+	switch {
+	case ip6 && (srcAddr == info.address || srcSubnet == info.subnet):
+		// Handling traffic from Yggdrasil sources.
+		if k.ckr.isYggdrasilAllowed(netip.AddrFrom16(srcAddr)) {
+			if k.ckr.yggdrasilFirewallAllows(bs) {
+				return true
 			}
+			k.ckr.rejected.add(rejectFirewall)
+			if k.allowICMPError(bs) {
+				if packet, ok := buildSourcePolicyResponse(bs, ip4, srcAddr, dstAddr); ok {
+					_, _ = k.conn.WriteTo(packet, iwt.Addr(srcKey))
+				}
+			}
+			return false
+		}
+		k.ckr.rejected.add(rejectYggdrasilRouting)
+		if k.allowICMPError(bs) {
 			if packet, ok := buildSourcePolicyResponse(bs, ip4, srcAddr, dstAddr); ok {
-				_, _ = k.core.WriteTo(packet, iwt.Addr(srcKey))
+				_, _ = k.conn.WriteTo(packet, iwt.Addr(srcKey))
 			}
-			continue
-		case ip4, ip6:
-			// Handling traffic from non-Yggdrasil sources, check for
-			// CKR routes that match the source address instead.
-			if addr, ok := netip.AddrFromSlice(srcAddr[:addrlen]); ok {
-				if key, err := k.ckr.getPublicKeyForAddress(addr); err != nil || !key.Equal(srcKey) {
-					if packet, ok := buildSourcePolicyResponse(bs, ip4, srcAddr, dstAddr); ok {
-						_, _ = k.writePC(packet)
-					}
-					continue
+		}
+		return false
+	case ip4, ip6:
+		// Handling traffic from non-Yggdrasil sources, check for
+		// CKR routes that match the source address instead.
+		addr, ok := netip.AddrFromSlice(srcAddr[:addrlen])
+		if !ok {
+			k.ckr.rejected.add(rejectNoRoute)
+			if k.allowICMPError(bs) {
+				if packet, ok := buildSourcePolicyResponse(bs, ip4, srcAddr, dstAddr); ok {
+					_, _ = k.writePC(packet)
 				}
-			} else {
+			}
+			return false
+		}
+		if !k.ckr.translateInbound(bs, addr, srcKey) {
+			k.ckr.rejected.add(rejectTranslation)
+			return false
+		}
+		if ip4 {
+			copy(srcAddr[:], bs[12:16])
+		} else {
+			copy(srcAddr[:], bs[8:24])
+		}
+		addr, _ = netip.AddrFromSlice(srcAddr[:addrlen])
+		dst, _ := netip.AddrFromSlice(dstAddr[:addrlen])
+		valid, allowed := k.ckr.isValidSource(addr, dst, srcKey, bs)
+		switch {
+		case !valid:
+			if k.allowICMPError(bs) {
 				if packet, ok := buildSourcePolicyResponse(bs, ip4, srcAddr, dstAddr); ok {
 					_, _ = k.writePC(packet)
 				}
-				continue
 			}
+			return false
+		case !allowed:
+			// The route's rules don't allow this traffic, so tell the
+			// sender directly.
+			if k.allowICMPError(bs) {
+				if packet, ok := buildSourcePolicyResponse(bs, ip4, srcAddr, dstAddr); ok {
+					_, _ = k.conn.WriteTo(packet, iwt.Addr(srcKey))
+				}
+			}
+			return false
+		}
+		if !k.ckr.nat.inbound(bs, time.Now()) {
+			k.ckr.rejected.add(rejectMasquerade)
+			return false
 		}
-		return copy(p, bs), nil
+		return true
 	}
+	return true
 }
 
 func buildOversizeResponse(bs []byte, mtu int) ([]byte, bool) {
@@ -348,6 +619,53 @@ func buildSourcePolicyResponse(bs []byte, ip4 bool, srcAddr, dstAddr address.Add
 	return buildDestinationUnreachableResponse(bs, src, dst, code)
 }
 
+func buildNoRouteResponse(bs []byte, ip4 bool, srcAddr, dstAddr address.Address) ([]byte, bool) {
+	var src, dst net.IP
+	code := icmpv6CodeNoRouteToDestination
+	switch {
+	case ip4:
+		src = net.IP(dstAddr[:4])
+		dst = net.IP(srcAddr[:4])
+		code = icmpv4CodeNetworkUnreachable
+	default:
+		src = net.IP(dstAddr[:])
+		dst = net.IP(srcAddr[:])
+	}
+	return buildDestinationUnreachableResponse(bs, src, dst, code)
+}
+
+// A packet that is being written. The caller's buffer must not be modified,
+// so the packet is copied into a buffer from the pool before it is changed by
+// masquerading or address translation.
+type outPacket struct {
+	bs     []byte
+	copied bool
+	pool   *sync.Pool // Copies are allocated instead if nil
+	pooled *[]byte
+}
+
+// Returns the packet in a buffer that can be modified, copying it first if
+// it is still in the caller's buffer.
+func (p *outPacket) writable() []byte {
+	if !p.copied {
+		var buf []byte
+		if p.pool != nil {
+			p.pooled = p.pool.Get().(*[]byte)
+			buf = (*p.pooled)[:0]
+		}
+		p.bs, p.copied = append(buf, p.bs...), true
+	}
+	return p.bs
+}
+
+// Returns the buffer of a copied packet to the pool.
+func (p *outPacket) release() {
+	if p.pooled != nil {
+		p.pool.Put(p.pooled)
+		p.pooled = nil
+	}
+}
+
 func (k *keyStore) writePC(bs []byte) (int, error) {
 	if len(bs) == 0 {
 		return 0, nil
@@ -360,30 +678,57 @@ func (k *keyStore) writePC(bs []byte) (int, error) {
 	if ip6 && len(bs) < 40 {
 		return len(bs), nil
 	}
-	var dstAddr address.Address
+	p := outPacket{bs: bs, pool: &k.buffers}
+	defer p.release()
+	k.ckr.nat.outbound(&p, time.Now())
+	packet := p.bs
+	var srcAddr, dstAddr address.Address
 	var dstSubnet address.Subnet
 	var addrlen int
 	switch {
 	case ip4:
-		copy(dstAddr[:], bs[16:20])
+		copy(srcAddr[:], packet[12:16])
+		copy(dstAddr[:], packet[16:20])
 		addrlen = 4
 	case ip6:
-		copy(dstAddr[:], bs[24:40])
-		copy(dstSubnet[:], bs[24:40])
+		copy(srcAddr[:], packet[8:24])
+		copy(dstAddr[:], packet[24:40])
+		copy(dstSubnet[:], packet[24:40])
 		addrlen = 16
 	}
+	ygg := k.ckr.yggdrasilRouting.Load() || ip6 && k.ckr.isYggdrasilAllowed(netip.AddrFrom16(dstAddr))
 	switch {
-	case k.ckr.config.YggdrasilRouting && dstAddr.IsValid():
-		k.sendToAddress(dstAddr, bs)
-	case k.ckr.config.YggdrasilRouting && dstSubnet.IsValid():
-		k.sendToSubnet(dstSubnet, bs)
+	case ygg && dstAddr.IsValid():
+		k.ckr.yggdrasilFirewallOutbound(packet)
+		k.sendToAddress(dstAddr, packet)
+	case ygg && dstSubnet.IsValid():
+		k.ckr.yggdrasilFirewallOutbound(packet)
+		k.sendToSubnet(dstSubnet, packet)
 	default:
 		if addr, ok := netip.AddrFromSlice(dstAddr[:addrlen]); ok {
-			key, err := k.ckr.getPublicKeyForAddress(addr)
-			if err != nil {
+			src, _ := netip.AddrFromSlice(srcAddr[:addrlen])
+			r, dest, err := k.ckr.getRouteForPacket(src, addr, packet)
+			switch {
+			case errors.Is(err, errPacketDenied), errors.Is(err, errRouteProhibit):
+				if k.allowICMPError(packet) {
+					if response, ok := buildSourcePolicyResponse(packet, ip4, srcAddr, dstAddr); ok {
+						k.sendLocal(response)
+					}
+				}
+				return len(bs), nil
+			case errors.Is(err, errNoRoute), errors.Is(err, errRouteUnreachable):
+				k.sendNoRoute(packet)
 				return len(bs), nil
+			case err != nil:
+				return len(bs), nil
+			}
+			if r.remote.IsValid() {
+				if packet = p.writable(); !translatePacket(packet, false, r.prefix, r.remote) {
+					return len(bs), nil
+				}
 			}
-			return k.core.WriteTo(bs, iwt.Addr(key[:]))
+			dest.state.sent(time.Now())
+			return k.conn.WriteTo(packet, iwt.Addr(dest.key))
 		} else {
 			return len(bs), nil
 		}
@@ -394,7 +739,7 @@ func (k *keyStore) writePC(bs []byte) (int, error) {
 // Exported API
 
 func (k *keyStore) MaxMTU() uint64 {
-	return k.core.MTU()
+	return k.conn.MTU()
 }
 
 func (k *keyStore) SetMTU(mtu uint64) {
@@ -415,18 +760,32 @@ type ReadWriteCloser struct {
 	keyStore
 }
 
+// RouteInstaller keeps the system routing table in step with the CKR routes
+// when they are changed at runtime.
+type RouteInstaller interface {
+	AddRoute(cidr string) error
+	RemoveRoute(cidr string) error
+}
+
 func NewReadWriteCloser(c *core.Core, log *log.Logger, config *config.TunnelRoutingConfig) *ReadWriteCloser {
 	rwc := new(ReadWriteCloser)
 	rwc.ckr.log = log
 	rwc.init(c)
+	rwc.setLimits(config)
 	if err := rwc.ckr.configure(config); err != nil {
 		panic(err)
 	}
+	go rwc.failoverRecovery()
+	go rwc.prober()
+	go rwc.pathWarmer()
+	go rwc.conntrackSweeper()
+	go rwc.keyStoreSweeper()
+	go rwc.advertiser()
 	return rwc
 }
 
 func (rwc *ReadWriteCloser) Address() address.Address {
-	if !rwc.ckr.config.YggdrasilRouting {
+	if !rwc.ckr.yggdrasilRouting.Load() && !rwc.ckr.hasYggdrasilAllowed() {
 		// If YggdrasilRouting is disabled then we don't need to populate the IPv6
 		// address on the TUN interface, returning a bad address here stops the TUN
 		// package from doing that.
@@ -436,7 +795,7 @@ func (rwc *ReadWriteCloser) Address() address.Address {
 }
 
 func (rwc *ReadWriteCloser) Subnet() address.Subnet {
-	if !rwc.ckr.config.YggdrasilRouting {
+	if !rwc.ckr.yggdrasilRouting.Load() && !rwc.ckr.hasYggdrasilAllowed() {
 		// If YggdrasilRouting is disabled then we don't need to populate the IPv6
 		// address on the TUN interface, returning a bad address here stops the TUN
 		// package from doing that.
@@ -445,6 +804,225 @@ func (rwc *ReadWriteCloser) Subnet() address.Subnet {
 	return rwc.subnet
 }
 
+// SetRouteInstaller sets the route installer that will be used to add and
+// remove system routes when CKR routes are changed at runtime, while
+// InstallRoutes is enabled. This should be called before setting up the admin
+// handlers.
+func (rwc *ReadWriteCloser) SetRouteInstaller(routes RouteInstaller) {
+	rwc.routes = routes
+}
+
+// AddRemoteSubnet adds a CKR route for the given subnet via the node with the
+// given public key. If a source subnet is given then the route only applies
+// to traffic from that subnet. If the subnet is already routed via other
+// nodes then the new node is added as another destination with the given
+// priority and weight.
+func (rwc *ReadWriteCloser) AddRemoteSubnet(subnet, source, key string, priority, weight int) error {
+	added, err := rwc.ckr.addRemoteSubnet(subnet, source, key, priority, weight)
+	if err != nil {
+		return err
+	}
+	rwc.ckr.log.Infof("Added remote subnet %s via %s", routeName(subnet, source), key)
+	if added {
+		_ = rwc.addSystemRoute(subnet)
+	}
+	return nil
+}
+
+// RemoveRemoteSubnet removes the CKR route for the given subnet and source
+// subnet, which is empty for routes that apply to all sources. If a public
+// key is given then only that node is removed from the route, and the route
+// itself is only removed if there are no other destinations left.
+func (rwc *ReadWriteCloser) RemoveRemoteSubnet(subnet, source, key string) error {
+	removed, err := rwc.ckr.removeRemoteSubnet(subnet, source, key)
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		rwc.ckr.log.Infof("Removed remote subnet %s via %s", routeName(subnet, source), key)
+	} else {
+		rwc.ckr.log.Infof("Removed remote subnet %s", routeName(subnet, source))
+	}
+	if removed {
+		_ = rwc.removeSystemRoute(subnet)
+	}
+	return nil
+}
+
+// ReplaceRemoteSubnet points the CKR route for the given subnet and source
+// subnet at only the node with the given public key, adding the route if it
+// does not already exist.
+func (rwc *ReadWriteCloser) ReplaceRemoteSubnet(subnet, source, key string) error {
+	added, err := rwc.ckr.replaceRemoteSubnet(subnet, source, key)
+	if err != nil {
+		return err
+	}
+	rwc.ckr.log.Infof("Replaced remote subnet %s via %s", routeName(subnet, source), key)
+	if added {
+		_ = rwc.addSystemRoute(subnet)
+	}
+	return nil
+}
+
+// Reconfigure applies a new tunnel routing configuration to the running node.
+// Changes to the remote subnets and to YggdrasilRouting take effect straight
+// away. If InstallRoutes is enabled then the system routes are added for all
+// of the routes, and if it is disabled then they are removed. An error is
+// returned if any system routes couldn't be changed, although the CKR routes
+// are changed regardless.
+func (rwc *ReadWriteCloser) Reconfigure(config *config.TunnelRoutingConfig) error {
+	installed := rwc.ckr.getInstallRoutes()
+	var before []string
+	if installed && !config.InstallRoutes {
+		before = rwc.ckr.getRoutePrefixes()
+	}
+	rwc.setLimits(config)
+	added, removed := rwc.ckr.reconfigure(config)
+	var errs []error
+	switch {
+	case rwc.routes == nil:
+	case installed && !config.InstallRoutes:
+		for _, subnet := range before {
+			errs = append(errs, rwc.routes.RemoveRoute(subnet))
+		}
+	case !installed && config.InstallRoutes:
+		for _, subnet := range rwc.ckr.getRoutePrefixes() {
+			errs = append(errs, rwc.routes.AddRoute(subnet))
+		}
+	default:
+		for _, subnet := range removed {
+			errs = append(errs, rwc.removeSystemRoute(subnet))
+		}
+		for _, subnet := range added {
+			errs = append(errs, rwc.addSystemRoute(subnet))
+		}
+	}
+	rwc.wakePathWarmer()
+	rwc.wakeProber()
+	return errors.Join(errs...)
+}
+
+// Adds a system route for the subnet if InstallRoutes is enabled. Failures
+// are logged as well as returned, as most callers can't report them.
+func (k *keyStore) addSystemRoute(subnet string) error {
+	if k.routes == nil || !k.ckr.getInstallRoutes() {
+		return nil
+	}
+	subnet = maskedSubnet(subnet)
+	if err := k.routes.AddRoute(subnet); err != nil {
+		k.ckr.log.Warnln("Failed to add route", subnet, "to routing table:", err)
+		return err
+	}
+	return nil
+}
+
+// Removes the system route for the subnet, as addSystemRoute adds it.
+func (k *keyStore) removeSystemRoute(subnet string) error {
+	if k.routes == nil || !k.ckr.getInstallRoutes() {
+		return nil
+	}
+	subnet = maskedSubnet(subnet)
+	if err := k.routes.RemoveRoute(subnet); err != nil {
+		k.ckr.log.Warnln("Failed to remove route", subnet, "from routing table:", err)
+		return err
+	}
+	return nil
+}
+
+// Returns the subnet as it is routed, without any host bits, so that the
+// system route matches the CKR route when the subnet was given as an address
+// within it, e.g. 10.0.0.1/8.
+func maskedSubnet(subnet string) string {
+	if prefix, err := netip.ParsePrefix(subnet); err == nil {
+		return prefix.Masked().String()
+	}
+	return subnet
+}
+
+// DestinationInfo describes the state of a remote node that is used by CKR
+// routes.
+type DestinationInfo struct {
+	Key            ed25519.PublicKey
+	Reachable      bool
+	RTT            time.Duration // Round-trip time of the last answered probe
+	LastProbeReply time.Time     // Zero if no probes have been answered
+	MissedProbes   int
+}
+
+// GetDestinations returns the state of each distinct remote node that is used
+// by CKR routes.
+func (rwc *ReadWriteCloser) GetDestinations() []DestinationInfo {
+	now := time.Now()
+	states := rwc.ckr.getKeyStates()
+	infos := make([]DestinationInfo, 0, len(states))
+	for _, state := range states {
+		down, _ := state.isDown(now)
+		info := DestinationInfo{
+			Key:          append(ed25519.PublicKey{}, state.key...),
+			Reachable:    !down,
+			RTT:          time.Duration(state.probe.rtt.Load()),
+			MissedProbes: int(state.probe.missed.Load()),
+		}
+		if last := state.probe.lastReply.Load(); last != 0 {
+			info.LastProbeReply = time.Unix(0, last)
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// GetRejectedPackets returns the number of packets from remote nodes that
+// have been rejected, by reason.
+func (rwc *ReadWriteCloser) GetRejectedPackets() map[string]uint64 {
+	return rwc.ckr.rejected.get()
+}
+
+// GetDroppedPending returns the number of packets that were dropped because
+// the buffers for packets waiting on key lookups were full.
+func (rwc *ReadWriteCloser) GetDroppedPending() uint64 {
+	return rwc.dropped.Load()
+}
+
+// GetSuppressedICMPErrors returns the number of ICMP errors that were not
+// sent because of the rate limits.
+func (rwc *ReadWriteCloser) GetSuppressedICMPErrors() uint64 {
+	return rwc.ckr.icmp.suppressed.Load()
+}
+
+// FlowInfo describes a flow that is being tracked for a stateful route.
+type FlowInfo struct {
+	Protocol   int
+	Local      netip.AddrPort // The port is zero for protocols without ports
+	Remote     netip.AddrPort
+	State      string
+	Created    time.Time
+	LastSeen   time.Time
+	Expires    time.Time
+	PacketsOut uint64
+	PacketsIn  uint64
+}
+
+// GetFlows returns the flows that are currently being tracked for stateful
+// routes, oldest first.
+func (rwc *ReadWriteCloser) GetFlows() []FlowInfo {
+	flows := rwc.ckr.conntrack.getFlows(time.Now())
+	infos := make([]FlowInfo, 0, len(flows))
+	for _, fl := range flows {
+		infos = append(infos, FlowInfo{
+			Protocol:   int(fl.key.protocol),
+			Local:      netip.AddrPortFrom(fl.key.local, fl.key.localPort),
+			Remote:     netip.AddrPortFrom(fl.key.remote, fl.key.remotePort),
+			State:      fl.state.String(),
+			Created:    fl.created,
+			LastSeen:   fl.lastSeen,
+			Expires:    fl.expires,
+			PacketsOut: fl.packetsOut,
+			PacketsIn:  fl.packetsIn,
+		})
+	}
+	return infos
+}
+
 func (rwc *ReadWriteCloser) Read(p []byte) (n int, err error) {
 	return rwc.readPC(p)
 }
@@ -454,6 +1032,9 @@ func (rwc *ReadWriteCloser) Write(p []byte) (n int, err error) {
 }
 
 func (rwc *ReadWriteCloser) Close() error {
+	rwc.closeOnce.Do(func() {
+		close(rwc.done)
+	})
 	err := rwc.core.Close()
 	rwc.core.Stop()
 	return err
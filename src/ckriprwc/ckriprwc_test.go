@@ -2,13 +2,27 @@ package ckriprwc
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
 	"net"
+	"net/netip"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 
+	iwt "github.com/Arceliar/ironwood/types"
+	"github.com/gologme/log"
+	"github.com/neilalexander/yggdrasilckr/src/config"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
 )
 
 func TestBuildOversizeResponseIPv6(t *testing.T) {
@@ -218,3 +232,931 @@ func TestBuildDestinationUnreachableResponseIPv4(t *testing.T) {
 		t.Fatalf("data mismatch")
 	}
 }
+
+func TestNoRouteResponse(t *testing.T) {
+	k := &keyStore{local: make(chan []byte, 16)}
+	k.ckr.log = log.New(io.Discard, "", 0)
+	_ = k.ckr.configure(&config.TunnelRoutingConfig{
+		RemoteSubnets: map[string][]string{testKey(0): {"10.0.0.0/8"}},
+		ICMPRateLimit: config.ICMPRateLimitConfig{PerDestinationRate: 1, PerDestinationBurst: 2},
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := k.writePC(testTCPPacket("192.168.1.2", "198.51.100.7", 40000, 443, 0x02)); err != nil {
+			t.Fatalf("writePC: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		packet := <-k.local
+		hdr, err := ipv4.ParseHeader(packet)
+		if err != nil {
+			t.Fatalf("ParseHeader: %v", err)
+		}
+		if hdr.Src.String() != "198.51.100.7" || hdr.Dst.String() != "192.168.1.2" {
+			t.Fatalf("unexpected response %s -> %s", hdr.Src, hdr.Dst)
+		}
+		msg, err := icmp.ParseMessage(1, packet[ipv4.HeaderLen:])
+		if err != nil {
+			t.Fatalf("ParseMessage: %v", err)
+		}
+		if msg.Type != ipv4.ICMPTypeDestinationUnreachable || msg.Code != icmpv4CodeNetworkUnreachable {
+			t.Fatalf("unexpected response type %v code %d", msg.Type, msg.Code)
+		}
+	}
+	select {
+	case <-k.local:
+		t.Fatal("expected the third response to be rate limited")
+	default:
+	}
+}
+
+func TestPendingBuffers(t *testing.T) {
+	var k keyStore
+	a, b := new(buffer), new(buffer)
+
+	// Packets are queued in order up to the limit for each destination.
+	for i := 0; i < pendingMaxPackets+2; i++ {
+		k._enqueue(a, []byte{byte(i)})
+	}
+	if len(a.packets) != pendingMaxPackets || k.dropped.Load() != 2 {
+		t.Fatalf("queued %d and dropped %d", len(a.packets), k.dropped.Load())
+	}
+
+	// The total size of all buffers is limited too.
+	big := make([]byte, 65535)
+	for k.pendingBytes+len(big) <= pendingMaxBytes {
+		k._enqueue(b, big)
+	}
+	k._enqueue(b, big)
+	if k.dropped.Load() != 3 {
+		t.Fatalf("expected the packet over the byte limit to be dropped, dropped %d", k.dropped.Load())
+	}
+
+	packets := k._dequeue(a)
+	for i, packet := range packets {
+		if packet[0] != byte(i) {
+			t.Fatalf("packet %d was queued out of order", i)
+		}
+	}
+	k._dequeue(b)
+	if k.pendingBytes != 0 || len(a.packets) != 0 || b.bytes != 0 {
+		t.Fatalf("expected the buffers to be empty, %d bytes remain", k.pendingBytes)
+	}
+}
+
+func TestShardedMap(t *testing.T) {
+	m := newShardedMap[int, int]()
+	for i := 0; i < 1000; i++ {
+		m.set(i, i*2)
+	}
+	if m.len() != 1000 || m.get(500) != 1000 || m.get(1000) != 0 {
+		t.Fatal("unexpected contents after setting")
+	}
+	sum := 0
+	for i, v := range m.all() {
+		if v != i*2 {
+			t.Fatalf("unexpected value %d for %d", v, i)
+		}
+		sum += i
+	}
+	if sum != 999*1000/2 {
+		t.Fatal("expected to iterate over every entry once")
+	}
+	keys := []int{5000}
+	for i := range 1000 {
+		keys = append(keys, i)
+	}
+	m.deleteKeys(keys, func(i, _ int) bool { return i%2 == 0 })
+	if m.len() != 500 || m.get(2) != 0 || m.get(3) != 6 {
+		t.Fatal("expected only the even entries to be deleted")
+	}
+}
+
+// A packetConn that records the packets and lookups sent through it, and
+// returns the packets queued on reads for reading.
+type fakeConn struct {
+	sync.Mutex
+	reads   chan fakePacket // Closed to make reads fail
+	written []fakePacket
+	lookups []ed25519.PublicKey
+}
+
+type fakePacket struct {
+	data []byte
+	addr net.Addr
+}
+
+func (c *fakeConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	r, ok := <-c.reads
+	if !ok {
+		return 0, nil, net.ErrClosed
+	}
+	return copy(p, r.data), r.addr, nil
+}
+
+func (c *fakeConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.written = append(c.written, fakePacket{append([]byte(nil), p...), addr})
+	return len(p), nil
+}
+
+func (c *fakeConn) SendLookup(key ed25519.PublicKey) {
+	c.Lock()
+	defer c.Unlock()
+	c.lookups = append(c.lookups, append(ed25519.PublicKey(nil), key...))
+}
+
+func (c *fakeConn) MTU() uint64 {
+	return 65535
+}
+
+// Takes the packets that have been written so far.
+func (c *fakeConn) takeWritten() []fakePacket {
+	c.Lock()
+	defer c.Unlock()
+	written := c.written
+	c.written = nil
+	return written
+}
+
+// Waits until at least n lookups have been sent, and takes them.
+func (c *fakeConn) waitLookups(t *testing.T, n int) []ed25519.PublicKey {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.Lock()
+		if lookups := c.lookups; len(lookups) >= n {
+			c.lookups = nil
+			c.Unlock()
+			return lookups
+		}
+		c.Unlock()
+	}
+	t.Fatalf("timed out waiting for %d lookups", n)
+	return nil
+}
+
+// Returns the public key for testKey(i).
+func testPublicKey(i int) ed25519.PublicKey {
+	key, _ := hex.DecodeString(testKey(i))
+	return key
+}
+
+// Returns a ReadWriteCloser that sends and receives packets through a
+// fakeConn.
+func testReadWriteCloser() *ReadWriteCloser {
+	k := &ReadWriteCloser{keyStore{
+		conn:         &fakeConn{reads: make(chan fakePacket, 16)},
+		keyToInfo:    newShardedMap[keyArray, *keyInfo](),
+		addrToInfo:   newShardedMap[address.Address, *keyInfo](),
+		addrBuffer:   make(map[address.Address]*buffer),
+		subnetToInfo: newShardedMap[address.Subnet, *keyInfo](),
+		subnetBuffer: make(map[address.Subnet]*buffer),
+		local:        make(chan []byte, 16),
+		warmup:       make(chan struct{}, 1),
+		reprobe:      make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}}
+	k.ckr.log = log.New(io.Discard, "", 0)
+	k.mtu.Store(1280)
+	k.buffers.New = func() any {
+		buf := make([]byte, 65535)
+		return &buf
+	}
+	k.setLimits(nil)
+	return k
+}
+
+func TestReadPC(t *testing.T) {
+	k := testReadWriteCloser()
+	conn := k.conn.(*fakeConn)
+	_ = k.ckr.configure(&config.TunnelRoutingConfig{
+		RemoteSubnets: map[string][]string{testKey(0): {"10.0.0.0/8"}},
+	})
+
+	// Locally generated packets come first, and packets from the network
+	// that aren't accepted are skipped.
+	local := testTCPPacket("198.51.100.7", "192.168.1.2", 443, 40000, 0x14)
+	k.sendLocal(local)
+	conn.reads <- fakePacket{testTCPPacket("10.1.2.3", "192.168.1.2", 40000, 22, 0x02), iwt.Addr(testPublicKey(1))}
+	conn.reads <- fakePacket{testTCPPacket("10.1.2.3", "192.168.1.2", 40000, 22, 0x02), iwt.Addr(testPublicKey(0))}
+	p := make([]byte, 1500) // Smaller than the MTU of the conn
+	for _, want := range [][]byte{local, testTCPPacket("10.1.2.3", "192.168.1.2", 40000, 22, 0x02)} {
+		n, err := k.readPC(p)
+		if err != nil {
+			t.Fatalf("readPC: %v", err)
+		}
+		if !bytes.Equal(p[:n], want) {
+			t.Fatalf("read %x, want %x", p[:n], want)
+		}
+	}
+
+	// A packet generated locally while a read is waiting for the network is
+	// returned straight away.
+	read := make(chan []byte)
+	go func() {
+		n, err := k.readPC(p)
+		if err != nil {
+			t.Errorf("readPC: %v", err)
+		}
+		read <- p[:n]
+	}()
+	time.Sleep(10 * time.Millisecond)
+	k.sendLocal(local)
+	select {
+	case got := <-read:
+		if !bytes.Equal(got, local) {
+			t.Fatalf("read %x, want %x", got, local)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the local packet to be returned without waiting for the network")
+	}
+
+	// Errors from the network are returned.
+	close(conn.reads)
+	if _, err := k.readPC(p); err == nil {
+		t.Fatal("expected an error once the conn is closed")
+	}
+}
+
+// A RouteInstaller that records the routes, and fails to add any in fail.
+type fakeRoutes struct {
+	routes map[string]bool
+	fail   map[string]bool
+}
+
+func (r *fakeRoutes) AddRoute(cidr string) error {
+	if r.fail[cidr] {
+		return fmt.Errorf("failed to add route %q", cidr)
+	}
+	r.routes[cidr] = true
+	return nil
+}
+
+func (r *fakeRoutes) RemoveRoute(cidr string) error {
+	delete(r.routes, cidr)
+	return nil
+}
+
+func TestReconfigureSystemRoutes(t *testing.T) {
+	rwc := testReadWriteCloser()
+	installed := &fakeRoutes{routes: map[string]bool{}}
+	rwc.SetRouteInstaller(installed)
+	_ = rwc.ckr.configure(&config.TunnelRoutingConfig{})
+	subnets := func(subnets ...string) map[string][]string {
+		return map[string][]string{testKey(0): subnets}
+	}
+	for i, test := range []struct {
+		config config.TunnelRoutingConfig
+		want   []string
+	}{
+		// Routes aren't installed until InstallRoutes is enabled, and then
+		// all of them are.
+		{config.TunnelRoutingConfig{RemoteSubnets: subnets("10.0.0.0/8")}, nil},
+		{config.TunnelRoutingConfig{InstallRoutes: true, RemoteSubnets: subnets("10.0.0.0/8", "172.16.0.0/12")}, []string{"10.0.0.0/8", "172.16.0.0/12"}},
+		{config.TunnelRoutingConfig{InstallRoutes: true, RemoteSubnets: subnets("172.16.0.0/12", "fd00::/8")}, []string{"172.16.0.0/12", "fd00::/8"}},
+		// Disabling it removes all of them, including those that were
+		// removed by the same change.
+		{config.TunnelRoutingConfig{RemoteSubnets: subnets("192.168.0.0/16")}, nil},
+		{config.TunnelRoutingConfig{RemoteSubnets: subnets("192.168.0.0/16", "fd00::/8")}, nil},
+		{config.TunnelRoutingConfig{InstallRoutes: true, RemoteSubnets: subnets("192.168.0.0/16", "fd00::/8")}, []string{"192.168.0.0/16", "fd00::/8"}},
+	} {
+		if err := rwc.Reconfigure(&test.config); err != nil {
+			t.Fatalf("%d: Reconfigure: %v", i, err)
+		}
+		if got := slices.Sorted(maps.Keys(installed.routes)); !slices.Equal(got, test.want) {
+			t.Fatalf("%d: installed routes %v, want %v", i, got, test.want)
+		}
+	}
+
+	// Routes that can't be installed are reported, but the CKR route is
+	// still added.
+	installed.fail = map[string]bool{"10.0.0.0/8": true}
+	err := rwc.Reconfigure(&config.TunnelRoutingConfig{InstallRoutes: true, RemoteSubnets: subnets("10.0.0.0/8", "fd00::/8")})
+	if err == nil {
+		t.Fatal("expected an error for the route that couldn't be installed")
+	}
+	if got := rwc.ckr.getRoutePrefixes(); !slices.Equal(got, []string{"10.0.0.0/8", "fd00::/8"}) {
+		t.Fatalf("unexpected CKR routes %v", got)
+	}
+}
+
+func TestRemoteSubnetSystemRoutes(t *testing.T) {
+	rwc := testReadWriteCloser()
+	installed := &fakeRoutes{routes: map[string]bool{}}
+	rwc.SetRouteInstaller(installed)
+	_ = rwc.ckr.configure(&config.TunnelRoutingConfig{InstallRoutes: true})
+
+	// System routes are for the subnet, not the address it was given as.
+	for i, test := range []struct {
+		change func() error
+		want   []string
+	}{
+		{func() error { return rwc.AddRemoteSubnet("10.0.0.1/8", "", testKey(0), 0, 1) }, []string{"10.0.0.0/8"}},
+		{func() error { return rwc.ReplaceRemoteSubnet("fd00::1/8", "", testKey(1)) }, []string{"10.0.0.0/8", "fd00::/8"}},
+		{func() error { return rwc.RemoveRemoteSubnet("10.1.2.3/8", "", "") }, []string{"fd00::/8"}},
+		{func() error { return rwc.RemoveRemoteSubnet("fd00::/8", "", testKey(1)) }, nil},
+	} {
+		if err := test.change(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got := slices.Sorted(maps.Keys(installed.routes)); !slices.Equal(got, test.want) {
+			t.Fatalf("%d: installed routes %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestPathWarmup(t *testing.T) {
+	rwc := testReadWriteCloser()
+	conn := rwc.conn.(*fakeConn)
+	routes := []config.RouteConfig{
+		{Subnet: "10.0.0.0/8", Destinations: []config.RouteDestinationConfig{{Key: testKey(1)}, {Key: testKey(0)}}},
+	}
+	_ = rwc.ckr.configure(&config.TunnelRoutingConfig{Routes: routes})
+	if interval := rwc.ckr.getPathWarmupInterval(); interval != 0 {
+		t.Fatalf("expected warm-up to be disabled by default, got %s", interval)
+	}
+
+	// Each destination is looked up once, in the order of their keys.
+	rwc.warmPaths()
+	lookups := conn.waitLookups(t, 2)
+	if len(lookups) != 2 || !bytes.Equal(lookups[0], testPublicKey(0)) || !bytes.Equal(lookups[1], testPublicKey(1)) {
+		t.Fatalf("unexpected lookups %x", lookups)
+	}
+
+	// Enabling warm-up wakes the warmer, which looks up the new destination
+	// too without waiting for the interval.
+	go rwc.pathWarmer()
+	defer close(rwc.done)
+	routes = append(routes, config.RouteConfig{Subnet: "172.16.0.0/12", Destinations: []config.RouteDestinationConfig{{Key: testKey(2)}}})
+	if err := rwc.Reconfigure(&config.TunnelRoutingConfig{Routes: routes, PathWarmupInterval: 60}); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	if interval := rwc.ckr.getPathWarmupInterval(); interval != time.Minute {
+		t.Fatalf("unexpected warm-up interval %s", interval)
+	}
+	lookups = conn.waitLookups(t, 3)
+	for i := range 3 {
+		if !bytes.Equal(lookups[i], testPublicKey(i)) {
+			t.Fatalf("unexpected lookups %x", lookups)
+		}
+	}
+}
+
+func TestProberWakes(t *testing.T) {
+	rwc := testReadWriteCloser()
+	conn := rwc.conn.(*fakeConn)
+	routes := []config.RouteConfig{
+		{Subnet: "10.0.0.0/8", Destinations: []config.RouteDestinationConfig{{Key: testKey(0)}}},
+	}
+	_ = rwc.ckr.configure(&config.TunnelRoutingConfig{Routes: routes})
+	go rwc.prober()
+	defer close(rwc.done)
+
+	// Nothing is probed while probing is disabled, and enabling it by
+	// reloading the configuration wakes the prober.
+	time.Sleep(1500 * time.Millisecond)
+	if written := conn.takeWritten(); len(written) != 0 {
+		t.Fatalf("expected no probes while disabled, got %d", len(written))
+	}
+	if err := rwc.Reconfigure(&config.TunnelRoutingConfig{Routes: routes, ProbeInterval: 60}); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if written := conn.takeWritten(); len(written) > 0 {
+			if written[0].data[0] != controlProbeRequest || !bytes.Equal(written[0].addr.(iwt.Addr), testPublicKey(0)) {
+				t.Fatalf("unexpected probe %+v", written[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a probe once probing was enabled")
+		}
+	}
+}
+
+func TestKeyStoreLimits(t *testing.T) {
+	k := testReadWriteCloser()
+	k.setLimits(&config.TunnelRoutingConfig{KeyStore: config.KeyStoreConfig{MaxKeys: 2, MaxPending: 2}})
+	if k.keyTTL != keyStoreDefaultKeyTTL || k.pendingTTL != keyStoreDefaultPendingTTL {
+		t.Fatalf("unexpected TTLs %s and %s", k.keyTTL, k.pendingTTL)
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	// The least recently used key is evicted to make room for a new one.
+	now := time.Now()
+	infos := make([]*keyInfo, 3)
+	for i := range infos {
+		infos[i] = &keyInfo{key: keyArray{byte(i)}, address: address.Address{0x02, byte(i)}, subnet: address.Subnet{0x03, byte(i)}}
+	}
+	k._addKey(infos[0])
+	infos[0].seen(now)
+	k._addKey(infos[1])
+	infos[1].seen(now.Add(time.Second))
+	infos[0].seen(now.Add(2 * time.Second))
+	k._addKey(infos[2])
+	if k.keyToInfo.get(infos[1].key) != nil || k.addrToInfo.get(infos[1].address) != nil || k.subnetToInfo.get(infos[1].subnet) != nil {
+		t.Fatal("expected the least recently used key to be evicted")
+	}
+	if k.keyToInfo.len() != 2 || k.keyToInfo.get(infos[0].key) != infos[0] || k.subnetToInfo.get(infos[2].subnet) != infos[2] {
+		t.Fatalf("unexpected keys after eviction")
+	}
+
+	// The same goes for buffers, whose packets are counted as dropped.
+	bufs := []*buffer{{address: address.Address{0x02, 1}}, {subnet: address.Subnet{0x03, 1}}, {address: address.Address{0x02, 2}}}
+	for _, buf := range bufs {
+		k._addBuffer(buf)
+		k._enqueue(buf, []byte{0x60})
+	}
+	if k.addrBuffer[bufs[0].address] != nil || len(k.addrBuffer)+len(k.subnetBuffer) != 2 || k.dropped.Load() != 1 || k.pendingBytes != 2 {
+		t.Fatal("expected the least recently used buffer to be evicted")
+	}
+	for _, buf := range bufs {
+		k._removeBuffer(buf)
+	}
+	if k.buffersHead != nil || k.buffersTail != nil || k.pendingBytes != 0 {
+		t.Fatal("expected no buffers to remain")
+	}
+}
+
+func TestKeyStoreEvictTies(t *testing.T) {
+	k := testReadWriteCloser()
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	// Only as many keys as needed are evicted, even if they were all last seen
+	// at the same time, and the older keys go first.
+	now := time.Now()
+	for i := range 10 {
+		info := &keyInfo{key: keyArray{byte(i)}, address: address.Address{0x02, byte(i)}, subnet: address.Subnet{0x03, byte(i)}}
+		if i < 2 {
+			info.seen(now.Add(-time.Minute))
+		} else {
+			info.seen(now)
+		}
+		k._addKey(info)
+	}
+	k._evictKeys(6)
+	if k.keyToInfo.len() != 6 || k.addrToInfo.len() != 6 || k.subnetToInfo.len() != 6 {
+		t.Fatalf("%d keys remain, want 6", k.keyToInfo.len())
+	}
+	for i := range 2 {
+		if k.keyToInfo.get(keyArray{byte(i)}) != nil {
+			t.Fatalf("expected the older key %d to be evicted", i)
+		}
+	}
+}
+
+func TestKeyStoreSweep(t *testing.T) {
+	k := testReadWriteCloser()
+	now := time.Now()
+	k.mutex.Lock()
+	idle, active := &keyInfo{key: keyArray{1}}, &keyInfo{key: keyArray{2}}
+	for _, info := range []*keyInfo{idle, active} {
+		k._addKey(info)
+	}
+	idle.lastSeen.Store(now.Add(-keyStoreDefaultKeyTTL).UnixNano())
+	active.lastSeen.Store(now.UnixNano())
+	buf := &buffer{address: address.Address{0x02, 1}}
+	k._addBuffer(buf)
+	k._enqueue(buf, testTCPPacket("200::1", "200::2", 40000, 22, 0x02))
+	k.mutex.Unlock()
+
+	// Nothing is waiting long enough to expire yet, apart from the idle key.
+	k.sweep(now)
+	if k.keyToInfo.get(idle.key) != nil || k.keyToInfo.get(active.key) == nil || k.addrBuffer[buf.address] == nil {
+		t.Fatal("expected only the idle key to expire")
+	}
+	if len(k.expiries) != 1 || k.expiries[0] != active || active.due != now.Add(keyStoreDefaultKeyTTL).UnixNano() {
+		t.Fatal("expected the active key to be checked again a TTL after it was seen")
+	}
+
+	// A key that is seen after it was last checked is put back rather than
+	// expired when it is due.
+	active.lastSeen.Store(now.Add(time.Minute).UnixNano())
+	k.sweep(now.Add(keyStoreDefaultKeyTTL))
+	if k.keyToInfo.get(active.key) == nil || active.due != now.Add(time.Minute+keyStoreDefaultKeyTTL).UnixNano() {
+		t.Fatal("expected the key that was seen again to be kept")
+	}
+	k.sweep(now.Add(time.Minute + keyStoreDefaultKeyTTL))
+	if k.keyToInfo.get(active.key) != nil || len(k.expiries) != 0 {
+		t.Fatal("expected the key to expire a TTL after it was last seen")
+	}
+
+	// The buffer expires later and its packet is answered.
+	k.sweep(time.Now().Add(keyStoreDefaultPendingTTL))
+	if k.addrBuffer[buf.address] != nil || k.buffersHead != nil || k.pendingBytes != 0 {
+		t.Fatal("expected the buffer to expire")
+	}
+	select {
+	case packet := <-k.local:
+		if f, _ := parsePacketFields(packet); f.protocol != 58 || f.icmpType != int(ipv6.ICMPTypeDestinationUnreachable) || f.dst.String() != "200::1" {
+			t.Fatalf("unexpected response %+v", f)
+		}
+	default:
+		t.Fatal("expected an ICMP no route message for the buffered packet")
+	}
+}
+
+// Measures a sweep of a full key store in which no keys have expired.
+func BenchmarkKeyStoreSweep(b *testing.B) {
+	k := testReadWriteCloser()
+	now := time.Now()
+	k.mutex.Lock()
+	for i := range keyStoreDefaultMaxKeys {
+		info := &keyInfo{key: keyArray{byte(i >> 8), byte(i)}, address: address.Address{0x02, byte(i >> 8), byte(i)}, subnet: address.Subnet{0x03, byte(i >> 8), byte(i)}}
+		info.lastSeen.Store(now.UnixNano())
+		k._addKey(info)
+	}
+	k.mutex.Unlock()
+	b.ReportAllocs()
+	for b.Loop() {
+		k.sweep(now)
+	}
+}
+
+// Measures the key store bookkeeping done for every packet received from a
+// node whose key is already known.
+func BenchmarkKeyStoreUpdate(b *testing.B) {
+	k := testReadWriteCloser()
+	key := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	k.update(key)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			k.update(key)
+		}
+	})
+}
+
+// A packetConn that discards the packets written to it and reads the same
+// packet forever, for measuring the packet path.
+type benchConn struct {
+	packet []byte
+	from   net.Addr
+}
+
+func (c *benchConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	return copy(p, c.packet), c.from, nil
+}
+
+func (c *benchConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+func (c *benchConn) SendLookup(key ed25519.PublicKey) {}
+
+func (c *benchConn) MTU() uint64 {
+	return 65535
+}
+
+func BenchmarkWritePC(b *testing.B) {
+	k := testReadWriteCloser()
+	k.conn = &benchConn{}
+	_ = k.ckr.configure(&config.TunnelRoutingConfig{
+		Routes: []config.RouteConfig{
+			{Subnet: "10.0.0.0/8", Destinations: []config.RouteDestinationConfig{{Key: testKey(0)}}},
+			{Subnet: "192.168.1.0/24", Alias: "10.200.6.0/24", Destinations: []config.RouteDestinationConfig{{Key: testKey(1)}}},
+		},
+	})
+	for name, packet := range map[string][]byte{
+		"Route": testTCPPacket("192.168.1.2", "10.1.2.3", 40000, 22, 0x10),
+		"Alias": testTCPPacket("192.168.1.2", "10.200.6.7", 40000, 22, 0x10),
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := k.writePC(packet); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/Parallel", func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := k.writePC(packet); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkReadPC(b *testing.B) {
+	k := testReadWriteCloser()
+	_ = k.ckr.configure(&config.TunnelRoutingConfig{
+		RemoteSubnets: map[string][]string{testKey(0): {"10.0.0.0/8"}},
+	})
+	packet := testTCPPacket("10.1.2.3", "192.168.1.2", 22, 40000, 0x10)
+	from := iwt.Addr(testPublicKey(0))
+	if !k.accept(append([]byte(nil), packet...), from) {
+		b.Fatal("expected the packet to be accepted")
+	}
+	k.conn = &benchConn{packet, from}
+	b.Run("Serial", func(b *testing.B) {
+		p := make([]byte, 1500) // Smaller than the MTU of the conn
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := k.readPC(p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			p := make([]byte, 1500)
+			for pb.Next() {
+				if _, err := k.readPC(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
+
+func TestICMPRateLimit(t *testing.T) {
+	var l icmpLimiter
+	l.configure(config.ICMPRateLimitConfig{Rate: 10, Burst: 5, PerDestinationRate: 1, PerDestinationBurst: 2})
+	now := time.Now()
+	a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+
+	// Each destination gets its own burst, within the overall burst.
+	for i, want := range []bool{true, true, false} {
+		if l.allow(a, now) != want {
+			t.Fatalf("error %d to a: expected %v", i, want)
+		}
+	}
+	for i, want := range []bool{true, true, false} {
+		if l.allow(b, now) != want {
+			t.Fatalf("error %d to b: expected %v", i, want)
+		}
+	}
+	if !l.allow(netip.MustParseAddr("10.0.0.3"), now) || l.allow(netip.MustParseAddr("10.0.0.4"), now) {
+		t.Fatal("expected the overall burst to be used up")
+	}
+	if n := l.suppressed.Load(); n != 3 {
+		t.Fatalf("suppressed = %d, want 3", n)
+	}
+
+	// Tokens are refilled over time.
+	now = now.Add(time.Second)
+	if !l.allow(a, now) || l.allow(a, now) {
+		t.Fatal("expected one more error to a after a second")
+	}
+
+	// Destinations with full buckets are forgotten to make room.
+	now = now.Add(time.Minute)
+	for i := 0; i < icmpMaxDestinations; i++ {
+		l.destinations[netip.AddrFrom4([4]byte{10, 1, byte(i >> 8), byte(i)})] = newRateLimiter(1, 2)
+	}
+	l.allow(netip.MustParseAddr("10.0.0.5"), now)
+	if n := len(l.destinations); n != 1 {
+		t.Fatalf("expected only one destination to be tracked, got %d", n)
+	}
+}
+
+func TestICMPRateLimitOverflow(t *testing.T) {
+	var l icmpLimiter
+	l.configure(config.ICMPRateLimitConfig{Rate: 1, Burst: 1, PerDestinationRate: 1, PerDestinationBurst: 2})
+	now := time.Now()
+	a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+
+	// A destination doesn't lose a token when the overall limit is reached.
+	if !l.allow(a, now) || l.allow(b, now) {
+		t.Fatal("expected only the first error to be allowed")
+	}
+	if tokens := l.destinations[b].tokens; tokens != 2 {
+		t.Fatalf("destination has %v tokens, want 2", tokens)
+	}
+
+	// Once no more destinations can be tracked, the rest share one bucket.
+	l.configure(config.ICMPRateLimitConfig{Rate: 1e6, Burst: 1e6, PerDestinationRate: 1, PerDestinationBurst: 1})
+	for i := 0; i < icmpMaxDestinations; i++ {
+		if !l.allow(netip.AddrFrom4([4]byte{10, 1, byte(i >> 8), byte(i)}), now) {
+			t.Fatalf("expected the first error to destination %d to be allowed", i)
+		}
+	}
+	if !l.allow(a, now) || l.allow(b, now) {
+		t.Fatal("expected the untracked destinations to share a bucket")
+	}
+	if n := len(l.destinations); n != icmpMaxDestinations {
+		t.Fatalf("%d destinations tracked, want %d", n, icmpMaxDestinations)
+	}
+}
+
+// Returns the ones' complement sum of the data, folded to 16 bits.
+func onesComplementSum(s uint32, b []byte) uint32 {
+	for i := 0; i < len(b); i += 2 {
+		if i+1 < len(b) {
+			s += uint32(binary.BigEndian.Uint16(b[i:]))
+		} else {
+			s += uint32(b[i]) << 8
+		}
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return s
+}
+
+// Returns the sum of the IPv4 header, if any, and the sum of the transport
+// checksum and the data it covers. Both are 0xffff if the checksums are
+// correct.
+func packetSums(bs []byte) (header, transport uint32) {
+	var pseudo uint32
+	var proto, off int
+	if bs[0]>>4 == 4 {
+		header = onesComplementSum(0, bs[:20])
+		pseudo, proto, off = onesComplementSum(0, bs[12:20]), int(bs[9]), 20
+	} else {
+		header = 0xffff
+		pseudo, proto, off = onesComplementSum(0, bs[8:40]), int(bs[6]), 40
+	}
+	if proto == 1 {
+		pseudo = 0
+	} else {
+		pseudo += uint32(len(bs)-off) + uint32(proto)
+	}
+	return header, onesComplementSum(pseudo, bs[off:])
+}
+
+func validChecksums(bs []byte) bool {
+	header, transport := packetSums(bs)
+	return header == 0xffff && transport == 0xffff
+}
+
+// Returns an IPv4 or IPv6 packet, depending on the addresses, with the given
+// payload and correct checksums.
+func testPacket(src, dst string, protocol byte, payload []byte) []byte {
+	s, d := netip.MustParseAddr(src), netip.MustParseAddr(dst)
+	var bs []byte
+	if s.Is4() {
+		bs = make([]byte, 20+len(payload))
+		bs[0], bs[8], bs[9] = 0x45, 64, protocol
+		binary.BigEndian.PutUint16(bs[2:], uint16(len(bs)))
+		copy(bs[12:], s.AsSlice())
+		copy(bs[16:], d.AsSlice())
+	} else {
+		bs = make([]byte, 40+len(payload))
+		bs[0], bs[6], bs[7] = 0x60, protocol, 64
+		binary.BigEndian.PutUint16(bs[4:], uint16(len(payload)))
+		copy(bs[8:], s.AsSlice())
+		copy(bs[24:], d.AsSlice())
+	}
+	off := len(bs) - len(payload)
+	copy(bs[off:], payload)
+	header, transport := packetSums(bs)
+	if s.Is4() {
+		binary.BigEndian.PutUint16(bs[10:], ^uint16(header))
+	}
+	if sum, ok := map[byte]int{1: 2, 6: 16, 17: 6, 58: 2}[protocol]; ok {
+		binary.BigEndian.PutUint16(bs[off+sum:], ^uint16(transport))
+	}
+	return bs
+}
+
+// Returns a TCP packet with no data.
+func testTCPPacket(src, dst string, sport, dport uint16, flags byte) []byte {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], sport)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	tcp[12], tcp[13] = 0x50, flags
+	return testPacket(src, dst, 6, tcp)
+}
+
+// Returns an ICMP or ICMPv6 message of the given type with no data, such as
+// an echo request with the given identifier.
+func testICMPPacket(src, dst string, typ byte, id uint16) []byte {
+	msg := make([]byte, 8)
+	msg[0] = typ
+	binary.BigEndian.PutUint16(msg[4:], id)
+	if netip.MustParseAddr(src).Is4() {
+		return testPacket(src, dst, 1, msg)
+	}
+	return testPacket(src, dst, 58, msg)
+}
+
+func TestMasquerade(t *testing.T) {
+	var n nat
+	v4, v6 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+	n.setAddresses(v4, v6, []netip.Addr{v4, v6})
+	now := time.Now()
+
+	// A TCP connection from a remote site out to the internet keeps its
+	// port, and the same port from another host gets a new one.
+	syn := testTCPPacket("10.1.2.3", "198.51.100.7", 40000, 443, 0x02)
+	if !validChecksums(syn) {
+		t.Fatal("test packet has bad checksums")
+	}
+	if !n.inbound(syn, now) {
+		t.Fatal("expected the packet to be translated")
+	}
+	f, _ := parsePacketFields(syn)
+	if f.src.String() != "192.0.2.1" || f.srcPort != 40000 || f.dst.String() != "198.51.100.7" || !validChecksums(syn) {
+		t.Fatalf("unexpected translation %s:%d -> %s:%d", f.src, f.srcPort, f.dst, f.dstPort)
+	}
+	other := testTCPPacket("10.1.2.4", "198.51.100.7", 40000, 443, 0x02)
+	if !n.inbound(other, now) {
+		t.Fatal("expected the packet to be translated")
+	}
+	if f, _ := parsePacketFields(other); f.src.String() != "192.0.2.1" || f.srcPort == 40000 || !validChecksums(other) {
+		t.Fatalf("unexpected translation %s:%d", f.src, f.srcPort)
+	}
+
+	// The reply is translated back to the original source, in a copy.
+	reply := testTCPPacket("198.51.100.7", "192.0.2.1", 443, 40000, 0x12)
+	p := outPacket{bs: reply}
+	n.outbound(&p, now)
+	if f, _ := parsePacketFields(p.bs); f.dst.String() != "10.1.2.3" || f.dstPort != 40000 || !validChecksums(p.bs) {
+		t.Fatalf("unexpected reply translation -> %s:%d", f.dst, f.dstPort)
+	}
+	if !bytes.Equal(reply, testTCPPacket("198.51.100.7", "192.0.2.1", 443, 40000, 0x12)) {
+		t.Fatal("expected the original packet not to be modified")
+	}
+
+	// An ICMPv6 error about a ping from the remote site is translated too.
+	ping := testICMPPacket("fd00::2", "2001:db8:ffff::9", 128, 7)
+	if !n.inbound(ping, now) {
+		t.Fatal("expected the ping to be translated")
+	}
+	if f, _ := parsePacketFields(ping); f.src.String() != "2001:db8::1" || !validChecksums(ping) {
+		t.Fatalf("unexpected ping source %s", f.src)
+	}
+	unreach, err := CreateICMPv6(net.IP(ping[8:24]), net.ParseIP("2001:db8:ff::1"), ipv6.ICMPTypeDestinationUnreachable, 0, &icmp.DstUnreach{Data: ping})
+	if err != nil {
+		t.Fatalf("CreateICMPv6: %v", err)
+	}
+	p = outPacket{bs: unreach}
+	n.outbound(&p, now)
+	unreach = p.bs
+	fu, _ := parsePacketFields(unreach)
+	fi, _ := parsePacketFields(unreach[fu.transport+8:])
+	if fu.dst.String() != "fd00::2" || fi.src.String() != "fd00::2" || !validChecksums(unreach) || !validChecksums(unreach[fu.transport+8:]) {
+		t.Fatalf("unexpected error translation -> %s about %s", fu.dst, fi.src)
+	}
+
+	// Traffic that can't be translated is dropped, and mappings expire.
+	gre := testTCPPacket("10.1.2.3", "198.51.100.7", 0, 0, 0)
+	gre[9] = 47
+	if n.inbound(gre, now) {
+		t.Fatal("expected GRE to be dropped")
+	}
+	n.expire(now.Add(conntrackTCPEstablishedTimeout))
+	if len(n.inside) != 0 || len(n.outside) != 0 {
+		t.Fatalf("expected all mappings to expire, %d remain", len(n.inside))
+	}
+}
+
+func TestMasqueradeReplies(t *testing.T) {
+	k := testReadWriteCloser()
+	conn := k.conn.(*fakeConn)
+	_ = k.ckr.configure(&config.TunnelRoutingConfig{
+		RemoteSubnets: map[string][]string{testKey(0): {"10.0.0.0/8"}},
+		Addresses:     []string{"192.0.2.1/24"},
+		Masquerade:    true,
+	})
+	from := iwt.Addr(testPublicKey(0))
+	reply := func(packet []byte) {
+		t.Helper()
+		want := append([]byte(nil), packet...)
+		if !k.accept(packet, from) {
+			t.Fatal("expected the reply to be accepted")
+		}
+		if !bytes.Equal(packet, want) {
+			f, _ := parsePacketFields(packet)
+			t.Fatalf("expected the reply not to be translated, got %s -> %s", f.src, f.dst)
+		}
+	}
+
+	// Replies to a connection from a host behind this node reach it as they
+	// are, including ICMP errors about it.
+	syn := testTCPPacket("192.168.1.2", "10.1.2.3", 40000, 22, 0x02)
+	if _, err := k.writePC(syn); err != nil || len(conn.takeWritten()) != 1 {
+		t.Fatalf("expected the packet to be sent, %v", err)
+	}
+	reply(testTCPPacket("10.1.2.3", "192.168.1.2", 22, 40000, 0x12))
+	unreach, _ := CreateICMPv4(net.ParseIP("192.168.1.2"), net.ParseIP("10.1.2.3"), ipv4.ICMPTypeDestinationUnreachable, 3, &icmp.DstUnreach{Data: syn})
+	reply(unreach)
+
+	// The same goes for an echo reply to this node itself.
+	echo, _ := CreateICMPv4(net.ParseIP("10.1.2.3"), net.ParseIP("192.0.2.1"), ipv4.ICMPTypeEcho, 0, &icmp.Echo{ID: 7, Seq: 1})
+	if _, err := k.writePC(echo); err != nil || len(conn.takeWritten()) != 1 {
+		t.Fatalf("expected the ping to be sent, %v", err)
+	}
+	pong, _ := CreateICMPv4(net.ParseIP("192.0.2.1"), net.ParseIP("10.1.2.3"), ipv4.ICMPTypeEchoReply, 0, &icmp.Echo{ID: 7, Seq: 1})
+	reply(pong)
+
+	// Traffic started from the remote side is still masqueraded.
+	out := testTCPPacket("10.1.2.3", "198.51.100.7", 40001, 443, 0x02)
+	if !k.accept(out, from) {
+		t.Fatal("expected the packet to be accepted")
+	}
+	if f, _ := parsePacketFields(out); f.src.String() != "192.0.2.1" {
+		t.Fatalf("expected the packet to be masqueraded, got %s", f.src)
+	}
+}
@@ -0,0 +1,361 @@
+package ckriprwc
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Routes can be made stateful, in which case traffic from the remote nodes
+// is only accepted if it belongs to a flow that was started from this side.
+// Flows are tracked in a table of bounded size. When the table is full, the
+// flow that was least recently used is evicted to make room for a new one.
+
+// Default maximum number of flows if ConntrackMaxEntries is not set.
+const conntrackDefaultMaxEntries = 65536
+
+// How often expired flows are removed from the table.
+const conntrackSweepInterval = 30 * time.Second
+
+const (
+	conntrackTCPSynSentTimeout     = 2 * time.Minute
+	conntrackTCPEstablishedTimeout = 2 * time.Hour
+	conntrackTCPClosingTimeout     = 2 * time.Minute
+	conntrackTCPClosedTimeout      = 10 * time.Second
+	conntrackUDPTimeout            = 30 * time.Second
+	conntrackUDPStreamTimeout      = 3 * time.Minute
+	conntrackICMPTimeout           = 30 * time.Second
+	conntrackOtherTimeout          = 10 * time.Minute
+)
+
+type flowState int
+
+const (
+	flowNew         flowState = iota // Not yet answered
+	flowEstablished                  // Answered by the remote side
+	flowClosing                      // TCP FIN seen
+	flowClosed                       // TCP RST seen
+)
+
+func (s flowState) String() string {
+	switch s {
+	case flowNew:
+		return "new"
+	case flowEstablished:
+		return "established"
+	case flowClosing:
+		return "closing"
+	default:
+		return "closed"
+	}
+}
+
+// Flows are identified from the point of view of this side, so that packets
+// in both directions map to the same key. For ICMP echo flows the local port
+// holds the echo identifier.
+type flowKey struct {
+	protocol   uint8
+	local      netip.Addr
+	remote     netip.Addr
+	localPort  uint16
+	remotePort uint16
+}
+
+type flow struct {
+	key        flowKey
+	state      flowState
+	created    time.Time
+	lastSeen   time.Time
+	expires    time.Time
+	packetsOut uint64
+	packetsIn  uint64
+	prev, next *flow // Least recently used list, most recent first
+}
+
+type conntrack struct {
+	sync.Mutex
+	flows      map[flowKey]*flow
+	head, tail *flow
+	maxEntries int
+}
+
+// Sets the maximum number of flows, evicting flows if there are now too many.
+func (t *conntrack) setMaxEntries(n int) {
+	t.Lock()
+	defer t.Unlock()
+	if n <= 0 {
+		n = conntrackDefaultMaxEntries
+	}
+	t.maxEntries = n
+	for len(t.flows) > t.maxEntries {
+		t._remove(t.tail)
+	}
+}
+
+// Returns the key of the flow that the packet belongs to, given whether the
+// packet is inbound, and whether the packet can be tracked at all.
+func flowKeyFor(f *packetFields, packet []byte, inbound bool) (flowKey, bool) {
+	if f.fragment {
+		return flowKey{}, false
+	}
+	k := flowKey{
+		protocol: uint8(f.protocol),
+		local:    f.src,
+		remote:   f.dst,
+	}
+	if inbound {
+		k.local, k.remote = f.dst, f.src
+	}
+	switch {
+	case f.srcPort >= 0:
+		k.localPort, k.remotePort = uint16(f.srcPort), uint16(f.dstPort)
+		if inbound {
+			k.localPort, k.remotePort = uint16(f.dstPort), uint16(f.srcPort)
+		}
+	case isICMPEcho(f):
+		if len(packet) < f.transport+8 {
+			return flowKey{}, false
+		}
+		k.localPort = uint16(packet[f.transport+4])<<8 | uint16(packet[f.transport+5])
+	}
+	return k, true
+}
+
+// Returns whether the packet is an ICMP or ICMPv6 echo request or reply.
+func isICMPEcho(f *packetFields) bool {
+	switch f.protocol {
+	case 1:
+		return f.icmpType == 0 || f.icmpType == 8
+	case 58:
+		return f.icmpType == 128 || f.icmpType == 129
+	}
+	return false
+}
+
+// Returns whether the packet is an ICMP or ICMPv6 error, which carries the
+// start of the packet that caused it.
+func isICMPError(f *packetFields) bool {
+	switch f.protocol {
+	case 1:
+		return f.icmpType == 3 || f.icmpType == 4 || f.icmpType == 11 || f.icmpType == 12
+	case 58:
+		return f.icmpType >= 1 && f.icmpType <= 4
+	}
+	return false
+}
+
+// Records an outbound packet, starting a new flow if needed.
+func (t *conntrack) outbound(f *packetFields, packet []byte, now time.Time) {
+	k, ok := flowKeyFor(f, packet, false)
+	if !ok {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	fl := t.flows[k]
+	if fl == nil || !now.Before(fl.expires) {
+		if fl != nil {
+			t._remove(fl)
+		}
+		fl = &flow{key: k, created: now}
+		t._insert(fl)
+	} else {
+		t._touch(fl)
+	}
+	fl.packetsOut++
+	fl.update(f, packet, false, now)
+}
+
+// Checks whether an inbound packet belongs to a flow that was started from
+// this side, updating the flow if so. ICMP errors are accepted if the packet
+// that caused them belongs to a flow.
+func (t *conntrack) inbound(f *packetFields, packet []byte, now time.Time) bool {
+	if isICMPError(f) {
+		inner, ok := parsePacketFields(packet[f.transport+8:])
+		if !ok {
+			return false
+		}
+		k, ok := flowKeyFor(&inner, packet[f.transport+8:], false)
+		if !ok {
+			return false
+		}
+		t.Lock()
+		defer t.Unlock()
+		fl := t.flows[k]
+		return fl != nil && now.Before(fl.expires)
+	}
+	k, ok := flowKeyFor(f, packet, true)
+	if !ok {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	fl := t.flows[k]
+	if fl == nil {
+		return false
+	}
+	if !now.Before(fl.expires) {
+		t._remove(fl)
+		return false
+	}
+	t._touch(fl)
+	fl.packetsIn++
+	fl.update(f, packet, true, now)
+	return true
+}
+
+// Updates the state and expiry of the flow for a packet that belongs to it.
+func (fl *flow) update(f *packetFields, packet []byte, inbound bool, now time.Time) {
+	fl.lastSeen = now
+	var timeout time.Duration
+	switch f.protocol {
+	case 6:
+		var flags byte
+		if len(packet) >= f.transport+14 {
+			flags = packet[f.transport+13]
+		}
+		const fin, syn, rst, ack = 0x01, 0x02, 0x04, 0x10
+		switch {
+		case flags&rst != 0:
+			fl.state = flowClosed
+		case flags&fin != 0 && fl.state != flowClosed:
+			fl.state = flowClosing
+		case fl.state == flowNew && inbound && flags&(syn|ack) == syn|ack:
+			fl.state = flowEstablished
+		case fl.state == flowNew && !inbound && flags&syn == 0:
+			// Picking up a connection that was already open.
+			fl.state = flowEstablished
+		}
+		switch fl.state {
+		case flowNew:
+			timeout = conntrackTCPSynSentTimeout
+		case flowEstablished:
+			timeout = conntrackTCPEstablishedTimeout
+		case flowClosing:
+			timeout = conntrackTCPClosingTimeout
+		default:
+			timeout = conntrackTCPClosedTimeout
+		}
+	case 17, 136:
+		if inbound {
+			fl.state = flowEstablished
+		}
+		timeout = conntrackUDPTimeout
+		if fl.state == flowEstablished {
+			timeout = conntrackUDPStreamTimeout
+		}
+	case 1, 58:
+		if inbound {
+			fl.state = flowEstablished
+		}
+		timeout = conntrackICMPTimeout
+	default:
+		if inbound {
+			fl.state = flowEstablished
+		}
+		timeout = conntrackOtherTimeout
+	}
+	fl.expires = now.Add(timeout)
+}
+
+// Adds a flow to the table, evicting the least recently used flow if the
+// table is full. Lock must be held.
+func (t *conntrack) _insert(fl *flow) {
+	if t.flows == nil {
+		t.flows = make(map[flowKey]*flow)
+	}
+	limit := t.maxEntries
+	if limit <= 0 {
+		limit = conntrackDefaultMaxEntries
+	}
+	for len(t.flows) >= limit && t.tail != nil {
+		t._remove(t.tail)
+	}
+	t.flows[fl.key] = fl
+	t._pushFront(fl)
+}
+
+// Removes a flow from the table. Lock must be held.
+func (t *conntrack) _remove(fl *flow) {
+	delete(t.flows, fl.key)
+	t._unlink(fl)
+}
+
+// Marks the flow as the most recently used. Lock must be held.
+func (t *conntrack) _touch(fl *flow) {
+	if t.head != fl {
+		t._unlink(fl)
+		t._pushFront(fl)
+	}
+}
+
+func (t *conntrack) _pushFront(fl *flow) {
+	fl.prev, fl.next = nil, t.head
+	if t.head != nil {
+		t.head.prev = fl
+	}
+	t.head = fl
+	if t.tail == nil {
+		t.tail = fl
+	}
+}
+
+func (t *conntrack) _unlink(fl *flow) {
+	if fl.prev != nil {
+		fl.prev.next = fl.next
+	} else {
+		t.head = fl.next
+	}
+	if fl.next != nil {
+		fl.next.prev = fl.prev
+	} else {
+		t.tail = fl.prev
+	}
+	fl.prev, fl.next = nil, nil
+}
+
+// Removes all flows that have expired.
+func (t *conntrack) expire(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	for _, fl := range t.flows {
+		if !now.Before(fl.expires) {
+			t._remove(fl)
+		}
+	}
+}
+
+// Returns copies of the flows in the table that have not expired, oldest
+// first.
+func (t *conntrack) getFlows(now time.Time) []flow {
+	t.Lock()
+	flows := make([]flow, 0, len(t.flows))
+	for _, fl := range t.flows {
+		if now.Before(fl.expires) {
+			c := *fl
+			c.prev, c.next = nil, nil
+			flows = append(flows, c)
+		}
+	}
+	t.Unlock()
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].created.Before(flows[j].created)
+	})
+	return flows
+}
+
+func (k *keyStore) conntrackSweeper() {
+	ticker := time.NewTicker(conntrackSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			k.ckr.conntrack.expire(now)
+			k.ckr.nat.expire(now)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package ckriprwc
+
+import (
+	"crypto/ed25519"
+
+	iwt "github.com/Arceliar/ironwood/types"
+)
+
+// Control messages are exchanged between yggdrasilckr nodes over the same
+// sessions as the tunnelled traffic. They are told apart from IP packets by
+// their first byte, which never has a 4 or 6 in the top nibble, so nodes
+// that don't understand them will just drop them.
+const (
+	controlProbeRequest  byte = 0x01
+	controlProbeResponse byte = 0x02
+	controlAdvertisement byte = 0x03
+)
+
+func (k *keyStore) handleControl(bs []byte, from ed25519.PublicKey) {
+	switch bs[0] {
+	case controlProbeRequest:
+		if len(bs) < probeMessageSize {
+			return
+		}
+		msg := append([]byte(nil), bs[:probeMessageSize]...)
+		msg[0] = controlProbeResponse
+		_, _ = k.conn.WriteTo(msg, iwt.Addr(from))
+
+	case controlProbeResponse:
+		k.handleProbeResponse(bs, from)
+
+	case controlAdvertisement:
+		k.handleAdvertisement(bs, from)
+	}
+}
@@ -1,13 +1,17 @@
 package ckriprwc
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/netip"
+	"slices"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gologme/log"
 
@@ -16,16 +20,185 @@ import (
 )
 
 type cryptokey struct {
-	log          *log.Logger
-	sync.RWMutex // Protects the below.
-	config       *config.TunnelRoutingConfig
-	v4Routes     []*route
-	v6Routes     []*route
+	log               *log.Logger
+	yggdrasilRouting  atomic.Bool
+	yggdrasilAllowed  atomic.Pointer[[]netip.Prefix] // Allowed even if YggdrasilRouting is disabled
+	yggdrasilFirewall atomic.Pointer[yggdrasilFirewall]
+	rejected          rejectCounters
+	table             atomic.Pointer[routeTable] // Used for lookups on the packet path
+	sync.RWMutex                                 // Protects the below, which are published as a new table when they change.
+	rpf               rpfMode                    // The reverse path filter mode for routes that don't set one, strict by default
+	config            *config.TunnelRoutingConfig
+	v4Routes          []*route
+	v6Routes          []*route
+	v4Trie            routeTrie
+	v6Trie            routeTrie
+	states            map[keyArray]*keyState
+	conntrack         conntrack
+	nat               nat
+	icmp              icmpLimiter // For ICMP errors generated locally
 }
 
 type route struct {
-	prefix      netip.Prefix
-	destination ed25519.PublicKey
+	prefix       netip.Prefix
+	source       netip.Prefix // Zero if the route applies to all sources
+	typ          routeType
+	destinations []*destination // Sorted in order of preference, empty unless the type is routeForward
+	rules        []rule
+	stateful     bool         // Only accept inbound traffic for flows started locally
+	remote       netip.Prefix // The prefix used at the remote side, if the route's prefix is an alias
+	rpf          rpfMode
+}
+
+// Routes normally forward traffic to remote nodes, but can instead discard it
+// or reject it with an ICMP error.
+type routeType int
+
+const (
+	routeForward routeType = iota
+	routeBlackhole
+	routeUnreachable
+	routeProhibit
+)
+
+var (
+	errNoRoute          = errors.New("no route")
+	errRouteBlackhole   = errors.New("destination is blackholed")
+	errRouteUnreachable = errors.New("destination is unreachable")
+	errRouteProhibit    = errors.New("destination is prohibited")
+)
+
+func (t routeType) String() string {
+	switch t {
+	case routeBlackhole:
+		return "blackhole"
+	case routeUnreachable:
+		return "unreachable"
+	case routeProhibit:
+		return "prohibit"
+	}
+	return "forward"
+}
+
+func parseRouteType(s string) (routeType, error) {
+	switch s {
+	case "", "forward":
+		return routeForward, nil
+	case "blackhole":
+		return routeBlackhole, nil
+	case "unreachable":
+		return routeUnreachable, nil
+	case "prohibit":
+		return routeProhibit, nil
+	}
+	return routeForward, fmt.Errorf("unknown route type %q", s)
+}
+
+// Returns the error for traffic that uses the route, or nil if the route
+// forwards traffic to remote nodes.
+func (t routeType) err() error {
+	switch t {
+	case routeBlackhole:
+		return errRouteBlackhole
+	case routeUnreachable:
+		return errRouteUnreachable
+	case routeProhibit:
+		return errRouteProhibit
+	}
+	return nil
+}
+
+// Routes are identified by their destination prefix and, for source-specific
+// routes, their source prefix.
+type routeKey struct {
+	prefix netip.Prefix
+	source netip.Prefix
+}
+
+func (r *route) key() routeKey {
+	return routeKey{prefix: r.prefix, source: r.source}
+}
+
+// Returns the length of the source prefix, or -1 if the route applies to all
+// sources, so that more specific sources sort first.
+func (r *route) sourceBits() int {
+	if !r.source.IsValid() {
+		return -1
+	}
+	return r.source.Bits()
+}
+
+// Returns whether the route applies to traffic from the given address.
+func (r *route) matchesSource(addr netip.Addr) bool {
+	return !r.source.IsValid() || r.source.Contains(addr)
+}
+
+// A snapshot of the routing table. Tables are replaced rather than modified,
+// so that packets can be routed without taking the lock.
+type routeTable struct {
+	rpf      rpfMode
+	v4Routes []*route
+	v6Routes []*route
+	v4Trie   routeTrie
+	v6Trie   routeTrie
+	states   map[keyArray]*keyState // Of the keys used by routes
+	aliases  map[keyArray][]*route  // The routes via each key that translate addresses, most specific first
+}
+
+var emptyRouteTable routeTable
+
+// Returns the current routing table.
+func (c *cryptokey) routes() *routeTable {
+	if t := c.table.Load(); t != nil {
+		return t
+	}
+	return &emptyRouteTable
+}
+
+// Publishes a new routing table with copies of the current routes. The slices
+// in routes are always replaced rather than modified, so they can be shared
+// with the copies. Write lock must be held.
+func (c *cryptokey) _publish() {
+	t := &routeTable{
+		rpf:      c.rpf,
+		v4Routes: make([]*route, 0, len(c.v4Routes)),
+		v6Routes: make([]*route, 0, len(c.v6Routes)),
+		states:   make(map[keyArray]*keyState, len(c.states)),
+	}
+	for _, routes := range [][]*route{c.v4Routes, c.v6Routes} {
+		for _, r := range routes {
+			nr := *r
+			if nr.prefix.Addr().Is6() {
+				t.v6Routes = append(t.v6Routes, &nr)
+				t.v6Trie.insert(&nr)
+			} else {
+				t.v4Routes = append(t.v4Routes, &nr)
+				t.v4Trie.insert(&nr)
+			}
+			for _, d := range nr.destinations {
+				var k keyArray
+				copy(k[:], d.key)
+				t.states[k] = d.state
+				if nr.remote.IsValid() {
+					if t.aliases == nil {
+						t.aliases = make(map[keyArray][]*route)
+					}
+					t.aliases[k] = append(t.aliases[k], &nr)
+				}
+			}
+		}
+	}
+	c.table.Store(t)
+}
+
+type destination struct {
+	key      ed25519.PublicKey
+	priority int
+	weight   int
+	hash     uint64 // Hash of the key, used for spreading flows
+	state    *keyState
+	learned  bool         // Advertised by the remote node, rather than configured
+	expires  atomic.Int64 // Unix nanoseconds when a learned destination expires
 }
 
 // Configure the CKR routes. This should only ever be ran by the TUN/TAP actor.
@@ -36,110 +209,735 @@ func (c *cryptokey) configure(config *config.TunnelRoutingConfig) error {
 	if c.config = config; c.config == nil {
 		return nil
 	}
+	c.yggdrasilRouting.Store(c.config.YggdrasilRouting)
+	c.setYggdrasilAllowed(c.config)
+	c.setYggdrasilFirewall(c.config)
+	c.rpf = c.configuredRPFMode(c.config)
 
 	c.v4Routes = make([]*route, 0, len(c.config.IPv4RemoteSubnets))
 	c.v6Routes = make([]*route, 0, len(c.config.IPv6RemoteSubnets))
+	c.v4Trie, c.v6Trie = routeTrie{}, routeTrie{}
+	c.states = make(map[keyArray]*keyState)
 
-	for ipv6, pubkey := range c.config.IPv6RemoteSubnets {
-		if err := c._addRemoteSubnet(ipv6, pubkey); err != nil {
-			c.log.Warnf("Error adding routed IPv6 subnet %q: %s", ipv6, err)
+	routes, options, errs := configuredRoutes(c.config)
+	for _, err := range errs {
+		c.log.Warnf("Error adding routed subnet: %s", err)
+	}
+	c.conntrack.setMaxEntries(int(c.config.ConntrackMaxEntries))
+	c.setMasquerade(c.config)
+	c.icmp.configure(c.config.ICMPRateLimit)
+	for _, err := range advertisementConfigErrors(c.config) {
+		c.log.Warnf("Error in advertisement configuration: %s", err)
+	}
+	for k, dests := range routes {
+		c._setRemoteSubnet(k, dests)
+		options[k].apply(c._getRoute(k))
+	}
+
+	c._sortRoutes()
+	c._publish()
+	c._logRoutes()
+
+	return nil
+}
+
+// Applies a new configuration to the CKR routes, leaving any routes that are
+// unchanged in place. Routes that were added at runtime are left alone unless
+// the new configuration replaces them. Returns the prefixes that were added
+// or removed so that the system routing table can be updated to match.
+func (c *cryptokey) reconfigure(config *config.TunnelRoutingConfig) (added, removed []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	current, _, _ := configuredRoutes(c.config)
+	next, options, errs := configuredRoutes(config)
+	for _, err := range errs {
+		c.log.Warnf("Error adding routed subnet: %s", err)
+	}
+	for _, err := range advertisementConfigErrors(config) {
+		c.log.Warnf("Error in advertisement configuration: %s", err)
+	}
+	c.config = config
+	c.yggdrasilRouting.Store(config.YggdrasilRouting)
+	c.setYggdrasilAllowed(config)
+	c.setYggdrasilFirewall(config)
+	c.rpf = c.configuredRPFMode(config)
+	c.conntrack.setMaxEntries(int(config.ConntrackMaxEntries))
+	c.setMasquerade(config)
+	c.icmp.configure(config.ICMPRateLimit)
+
+	for k := range current {
+		if _, ok := next[k]; ok {
+			continue
+		}
+		if c._removeRoute(k) {
+			removed = append(removed, k.prefix.String())
 		}
 	}
 
-	for ipv4, pubkey := range c.config.IPv4RemoteSubnets {
-		if err := c._addRemoteSubnet(ipv4, pubkey); err != nil {
-			c.log.Warnf("Error adding routed IPv4 subnet %q: %s", ipv4, err)
+	for k, dests := range next {
+		if c._setRemoteSubnet(k, dests) {
+			added = append(added, k.prefix.String())
 		}
+		options[k].apply(c._getRoute(k))
+	}
+
+	c._rebuildTries()
+	c._sortRoutes()
+	c._publish()
+	c._logRoutes()
+
+	return added, removed
+}
+
+// The options that can be set on configured routes. Entries in Routes with
+// the same subnet and source are combined.
+type routeOptions struct {
+	typ      routeType
+	rules    []rule
+	stateful bool
+	remote   netip.Prefix
+	rpf      rpfMode
+}
+
+func (o *routeOptions) apply(r *route) {
+	if o == nil {
+		o = &routeOptions{}
 	}
+	r.typ, r.rules, r.stateful, r.remote, r.rpf = o.typ, o.rules, o.stateful, o.remote, o.rpf
+}
 
-	for pubkey, ips := range c.config.RemoteSubnets {
-		for _, ip := range ips {
-			if err := c._addRemoteSubnet(ip, pubkey); err != nil {
-				c.log.Warnf("Error adding routed subnet %q: %s", ip, err)
+// Returns the global reverse path filter mode from the configuration.
+func (c *cryptokey) configuredRPFMode(config *config.TunnelRoutingConfig) rpfMode {
+	mode, err := parseRPFMode(config.ReversePathFilter)
+	if err != nil {
+		c.log.Warnf("Error in reverse path filter configuration: %s", err)
+	}
+	return mode
+}
+
+// Returns the routes described by the configuration and their options, along
+// with errors for any entries that are not valid. The destinations are not
+// yet attached to any key state.
+func configuredRoutes(config *config.TunnelRoutingConfig) (map[routeKey][]*destination, map[routeKey]*routeOptions, []error) {
+	routes := map[routeKey][]*destination{}
+	options := map[routeKey]*routeOptions{}
+	var errs []error
+	if config == nil {
+		return routes, options, nil
+	}
+	add := func(cidr, source, dest string, priority, weight int) {
+		prefix, bpk, err := parseRemoteSubnet(cidr, dest)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", cidr, err))
+			return
+		}
+		src, err := parseSourceSubnet(source, prefix)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", cidr, err))
+			return
+		}
+		k := routeKey{prefix: prefix, source: src}
+		for _, d := range routes[k] {
+			if d.key.Equal(bpk) {
+				errs = append(errs, fmt.Errorf("%q: destination %s listed more than once", cidr, dest))
+				return
 			}
 		}
+		routes[k] = append(routes[k], &destination{
+			key:      bpk,
+			priority: priority,
+			weight:   weight,
+		})
+	}
+	for cidr, dest := range config.IPv6RemoteSubnets {
+		add(cidr, "", dest, 0, 1)
+	}
+	for cidr, dest := range config.IPv4RemoteSubnets {
+		add(cidr, "", dest, 0, 1)
+	}
+	for dest, cidrs := range config.RemoteSubnets {
+		for _, cidr := range cidrs {
+			add(cidr, "", dest, 0, 1)
+		}
 	}
+	for _, r := range config.Routes {
+		subnet := r.Subnet
+		var remote netip.Prefix
+		if r.Alias != "" {
+			var err error
+			if remote, _, err = parseAlias(r.Subnet, r.Alias); err != nil {
+				errs = append(errs, fmt.Errorf("%q: %w", r.Subnet, err))
+				continue
+			}
+			subnet = r.Alias
+		}
+		typ, err := parseRouteType(r.Type)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", r.Subnet, err))
+			continue
+		}
+		if typ != routeForward && len(r.Destinations) > 0 {
+			errs = append(errs, fmt.Errorf("%q: %s routes can't have destinations", r.Subnet, typ))
+			continue
+		}
+		for _, d := range r.Destinations {
+			add(subnet, r.Source, d.Key, d.Priority, d.Weight)
+		}
+		if len(r.Rules) == 0 && !r.Stateful && r.Alias == "" && r.ReversePathFilter == "" && typ == routeForward {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(subnet)
+		if err != nil {
+			if typ != routeForward {
+				errs = append(errs, fmt.Errorf("%q: %w", r.Subnet, err))
+			}
+			continue // Otherwise already reported above
+		}
+		src, err := parseSourceSubnet(r.Source, prefix)
+		if err != nil {
+			continue
+		}
+		k := routeKey{prefix: prefix.Masked(), source: src}
+		o := options[k]
+		if o == nil {
+			o = &routeOptions{}
+			options[k] = o
+		}
+		o.stateful = o.stateful || r.Stateful
+		if typ != routeForward {
+			o.typ = typ
+		}
+		if remote.IsValid() {
+			o.remote = remote
+		}
+		if mode, err := parseRPFMode(r.ReversePathFilter); err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", r.Subnet, err))
+		} else if mode != rpfDefault {
+			o.rpf = mode
+		}
+		for i, rc := range r.Rules {
+			parsed, err := parseRule(rc, prefix.Addr().Is6())
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%q: rule %d: %w", r.Subnet, i+1, err))
+				continue
+			}
+			o.rules = append(o.rules, parsed)
+		}
+	}
+	for k, o := range options {
+		if o.typ == routeForward {
+			continue
+		}
+		if len(routes[k]) > 0 {
+			errs = append(errs, fmt.Errorf("%q: %s route conflicts with a route via remote nodes", k.prefix, o.typ))
+			o.typ = routeForward
+			continue
+		}
+		routes[k] = nil
+	}
+	return routes, options, errs
+}
 
+// Logs the active routes. Read lock must be held.
+func (c *cryptokey) _logRoutes() {
 	if len(c.v6Routes) > 0 {
-		sort.Slice(c.v6Routes, func(i, j int) bool {
-			return sortRoutes(c.v6Routes, i, j)
-		})
-
 		c.log.Println("Active IPv6 routes:")
 		for _, r := range c.v6Routes {
-			c.log.Println(" -", r.prefix, "via", hex.EncodeToString(r.destination))
+			r.log(c.log)
 		}
 	} else {
 		c.log.Println("No active IPv6 routes")
 	}
 
 	if len(c.v4Routes) > 0 {
-		sort.Slice(c.v4Routes, func(i, j int) bool {
-			return sortRoutes(c.v4Routes, i, j)
-		})
-
 		c.log.Println("Active IPv4 routes:")
 		for _, r := range c.v4Routes {
-			c.log.Println(" -", r.prefix, "via", hex.EncodeToString(r.destination))
+			r.log(c.log)
 		}
 	} else {
 		c.log.Println("No active IPv4 routes")
 	}
+}
 
-	return nil
+func (r *route) log(log *log.Logger) {
+	name := r.prefix.String()
+	if r.remote.IsValid() {
+		name += " as " + r.remote.String()
+	}
+	if r.source.IsValid() {
+		name += " from " + r.source.String()
+	}
+	if r.typ != routeForward {
+		log.Println(" -", name, r.typ)
+		return
+	}
+	if len(r.destinations) == 1 {
+		if r.destinations[0].learned {
+			log.Println(" -", name, "via", hex.EncodeToString(r.destinations[0].key), "(learned)")
+			return
+		}
+		log.Println(" -", name, "via", hex.EncodeToString(r.destinations[0].key))
+		return
+	}
+	for _, d := range r.destinations {
+		log.Println(" -", name, "via", hex.EncodeToString(d.key), "priority", d.priority, "weight", d.weight)
+	}
 }
 
-// Adds a destination route for the given CIDR to be tunnelled to the node
-// with the given BoxPubKey. Write lock must be held.
-func (c *cryptokey) _addRemoteSubnet(cidr string, dest string) error {
+// Parses and validates a CIDR and the hex-encoded public key of the node that
+// it should be routed to.
+func parseRemoteSubnet(cidr string, dest string) (netip.Prefix, ed25519.PublicKey, error) {
 	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
-		return err
+		return netip.Prefix{}, nil, err
 	}
+	prefix = prefix.Masked()
 
 	bpk, err := hex.DecodeString(dest)
 	if err != nil {
-		return fmt.Errorf("hex.DecodeString: %w", err)
+		return netip.Prefix{}, nil, fmt.Errorf("hex.DecodeString: %w", err)
 	} else if len(bpk) != ed25519.PublicKeySize {
-		return fmt.Errorf("incorrect key length for %q", dest)
+		return netip.Prefix{}, nil, fmt.Errorf("incorrect key length for %q", dest)
 	}
 
-	is4, is6 := prefix.Addr().Is4(), prefix.Addr().Is6()
 	switch {
-	case is6:
+	case prefix.Addr().Is6():
 		if isYggdrasilDestination(prefix.Addr()) {
-			return errors.New("can't specify Yggdrasil destination as routed subnet")
+			return netip.Prefix{}, nil, errors.New("can't specify Yggdrasil destination as routed subnet")
 		}
-		for _, route := range c.v6Routes {
-			if route.prefix == prefix {
-				return fmt.Errorf("remote subnet already exists for %s", cidr)
-			}
+	case prefix.Addr().Is4():
+	default:
+		return netip.Prefix{}, nil, fmt.Errorf("unexpected prefix size")
+	}
+
+	return prefix, ed25519.PublicKey(bpk), nil
+}
+
+// Parses and validates the source CIDR of a route to the given prefix. An
+// empty source means that the route applies to all sources and returns the
+// zero prefix.
+func parseSourceSubnet(source string, prefix netip.Prefix) (netip.Prefix, error) {
+	if source == "" {
+		return netip.Prefix{}, nil
+	}
+	src, err := netip.ParsePrefix(source)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("source: %w", err)
+	}
+	if src.Addr().Is4() != prefix.Addr().Is4() {
+		return netip.Prefix{}, fmt.Errorf("source %s is not the same address family", source)
+	}
+	return src.Masked(), nil
+}
+
+// Returns the route trie for the address family of the given prefix. Read
+// lock must be held.
+func (c *cryptokey) _trie(prefix netip.Prefix) *routeTrie {
+	if prefix.Addr().Is6() {
+		return &c.v6Trie
+	}
+	return &c.v4Trie
+}
+
+// Returns the route for exactly the given prefix and source, or nil if there
+// isn't one. Read lock must be held.
+func (c *cryptokey) _getRoute(k routeKey) *route {
+	return c._trie(k.prefix).get(k.prefix, k.source)
+}
+
+// Sets the destinations of the route for the given prefix and source,
+// creating the route if it does not already exist. Returns true if this is
+// the first route for the prefix, in which case a system route is needed for
+// it. The route lists must be sorted afterwards. Write lock must be held.
+func (c *cryptokey) _setRemoteSubnet(k routeKey, dests []*destination) bool {
+	for _, d := range dests {
+		if d.state != nil {
+			// Already in use by a route, and so maybe by a published table.
+			continue
 		}
-		c.v6Routes = append(c.v6Routes, &route{
-			prefix:      prefix,
-			destination: append(ed25519.PublicKey{}, bpk...),
-		})
+		if d.weight <= 0 {
+			d.weight = 1
+		}
+		d.hash = keyHash(d.key)
+		d.state = c._getKeyState(d.key)
+	}
+	sort.SliceStable(dests, func(i, j int) bool {
+		return sortDestinations(dests, i, j)
+	})
 
-	case is4:
-		for _, route := range c.v4Routes {
-			if route.prefix == prefix {
-				return fmt.Errorf("remote subnet already exists for %s", cidr)
+	if r := c._getRoute(k); r != nil {
+		r.destinations = dests
+		return false
+	}
+
+	r := &route{
+		prefix:       k.prefix,
+		source:       k.source,
+		destinations: dests,
+	}
+	trie := c._trie(k.prefix)
+	first := !trie.has(k.prefix)
+	trie.insert(r)
+	if k.prefix.Addr().Is6() {
+		c.v6Routes = append(c.v6Routes, r)
+	} else {
+		c.v4Routes = append(c.v4Routes, r)
+	}
+	return first
+}
+
+// Adds a destination for the given CIDR, optionally only for traffic from the
+// given source CIDR, to be tunnelled to the node with the given BoxPubKey.
+// Returns true if this is the first route for the CIDR. Write lock must be
+// held.
+func (c *cryptokey) _addRemoteSubnet(cidr, source, dest string, priority, weight int) (bool, error) {
+	prefix, bpk, err := parseRemoteSubnet(cidr, dest)
+	if err != nil {
+		return false, err
+	}
+	src, err := parseSourceSubnet(source, prefix)
+	if err != nil {
+		return false, err
+	}
+	k := routeKey{prefix: prefix, source: src}
+
+	var dests []*destination
+	if r := c._getRoute(k); r != nil {
+		if r.typ != routeForward {
+			return false, fmt.Errorf("remote subnet %s is a %s route", routeName(cidr, source), r.typ)
+		}
+		for _, d := range r.destinations {
+			if d.learned {
+				// Configured destinations replace learned ones.
+				continue
+			}
+			if d.key.Equal(bpk) {
+				return false, fmt.Errorf("remote subnet already exists for %s via %s", cidr, dest)
 			}
+			dests = append(dests, d)
 		}
-		c.v4Routes = append(c.v4Routes, &route{
-			prefix:      prefix,
-			destination: append(ed25519.PublicKey{}, bpk...),
-		})
+	}
+	dests = append(dests, &destination{
+		key:      bpk,
+		priority: priority,
+		weight:   weight,
+	})
 
+	return c._setRemoteSubnet(k, dests), nil
+}
+
+// Removes the destination for the given CIDR and source CIDR that points to
+// the node with the given BoxPubKey, or all destinations if no key is given.
+// Returns true if no routes for the CIDR remain. Write lock must be held.
+func (c *cryptokey) _removeRemoteSubnet(cidr, source, dest string) (bool, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return false, err
+	}
+	prefix = prefix.Masked()
+	src, err := parseSourceSubnet(source, prefix)
+	if err != nil {
+		return false, err
+	}
+	k := routeKey{prefix: prefix, source: src}
+
+	r := c._getRoute(k)
+	if r == nil {
+		return false, fmt.Errorf("remote subnet %s does not exist", routeName(cidr, source))
+	}
+	if dest == "" {
+		return c._removeRoute(k), nil
+	}
+
+	bpk, err := hex.DecodeString(dest)
+	if err != nil {
+		return false, fmt.Errorf("hex.DecodeString: %w", err)
+	}
+	dests := make([]*destination, 0, len(r.destinations))
+	for _, d := range r.destinations {
+		if !bytes.Equal(d.key, bpk) {
+			dests = append(dests, d)
+		}
+	}
+	switch len(dests) {
+	case len(r.destinations):
+		return false, fmt.Errorf("remote subnet %s is not routed via %s", routeName(cidr, source), dest)
+	case 0:
+		return c._removeRoute(k), nil
 	default:
-		return fmt.Errorf("unexpected prefix size")
+		r.destinations = dests
+		return false, nil
 	}
+}
 
-	return nil
+// Returns whether the given CIDR is already routed via the node with the
+// given BoxPubKey by a configured route.
+func (c *cryptokey) hasRemoteSubnet(cidr string, dest string) bool {
+	prefix, bpk, err := parseRemoteSubnet(cidr, dest)
+	if err != nil {
+		return false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if r := c._getRoute(routeKey{prefix: prefix}); r != nil {
+		for _, d := range r.destinations {
+			if !d.learned && d.key.Equal(bpk) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Removes the route for the given prefix and source entirely. Returns true if
+// no routes for the prefix remain. The route tries should be rebuilt
+// afterwards to tidy them up. Write lock must be held.
+func (c *cryptokey) _removeRoute(k routeKey) bool {
+	routes := &c.v4Routes
+	if k.prefix.Addr().Is6() {
+		routes = &c.v6Routes
+	}
+	for i, r := range *routes {
+		if r.key() == k {
+			*routes = append((*routes)[:i:i], (*routes)[i+1:]...)
+			trie := c._trie(k.prefix)
+			trie.remove(k.prefix, k.source)
+			return !trie.has(k.prefix)
+		}
+	}
+	return false
+}
+
+// Returns a description of the route for logging and errors.
+func routeName(cidr, source string) string {
+	if source == "" {
+		return cidr
+	}
+	return cidr + " from " + source
+}
+
+// Returns the shared state for the given destination key, creating it if it
+// does not already exist. Write lock must be held.
+func (c *cryptokey) _getKeyState(key ed25519.PublicKey) *keyState {
+	var k keyArray
+	copy(k[:], key)
+	if c.states == nil {
+		c.states = make(map[keyArray]*keyState)
+	}
+	state := c.states[k]
+	if state == nil {
+		state = &keyState{key: append(ed25519.PublicKey{}, key...)}
+		c.states[k] = state
+	}
+	return state
+}
+
+// Adds a destination route at runtime, keeping the route lists sorted.
+// Returns true if this is the first route for the CIDR.
+func (c *cryptokey) addRemoteSubnet(cidr, source, dest string, priority, weight int) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	added, err := c._addRemoteSubnet(cidr, source, dest, priority, weight)
+	if err != nil {
+		return false, err
+	}
+	c._sortRoutes()
+	c._publish()
+	return added, nil
+}
+
+// Removes a destination route at runtime. Returns true if no routes for the
+// CIDR remain.
+func (c *cryptokey) removeRemoteSubnet(cidr, source, dest string) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	removed, err := c._removeRemoteSubnet(cidr, source, dest)
+	if err != nil {
+		return false, err
+	}
+	c._rebuildTries()
+	c._publish()
+	return removed, nil
+}
+
+// Points the route for the given CIDR and source CIDR at only the given node,
+// or adds the route if it does not already exist. Returns true if this is the
+// first route for the CIDR.
+func (c *cryptokey) replaceRemoteSubnet(cidr, source, dest string) (bool, error) {
+	prefix, bpk, err := parseRemoteSubnet(cidr, dest)
+	if err != nil {
+		return false, err
+	}
+	src, err := parseSourceSubnet(source, prefix)
+	if err != nil {
+		return false, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	k := routeKey{prefix: prefix, source: src}
+	added := c._setRemoteSubnet(k, []*destination{{key: bpk}})
+	c._getRoute(k).typ = routeForward
+	c._rebuildTries()
+	c._sortRoutes()
+	c._publish()
+	return added, nil
+}
+
+// Rebuilds the route tries from the route lists and forgets the state of any
+// keys that are no longer used by a route. Write lock must be held.
+func (c *cryptokey) _rebuildTries() {
+	c.v4Trie, c.v6Trie = newRouteTrie(c.v4Routes), newRouteTrie(c.v6Routes)
+	c._forgetKeyStates()
+}
+
+// Forgets the state of any keys that are no longer used by a route. Write lock
+// must be held.
+func (c *cryptokey) _forgetKeyStates() {
+	states := make(map[keyArray]*keyState, len(c.states))
+	for _, routes := range [][]*route{c.v4Routes, c.v6Routes} {
+		for _, r := range routes {
+			for _, d := range r.destinations {
+				var k keyArray
+				copy(k[:], d.key)
+				states[k] = d.state
+			}
+		}
+	}
+	c.states = states
+}
+
+// Sorts the route lists. Write lock must be held.
+func (c *cryptokey) _sortRoutes() {
+	sort.Slice(c.v6Routes, func(i, j int) bool {
+		return sortRoutes(c.v6Routes, i, j)
+	})
+	sort.Slice(c.v4Routes, func(i, j int) bool {
+		return sortRoutes(c.v4Routes, i, j)
+	})
+}
+
+// Returns copies of the active IPv4 and IPv6 routes, with the most specific
+// routes first.
+func (c *cryptokey) getRoutes() (v4, v6 []route) {
+	t := c.routes()
+	v4 = make([]route, 0, len(t.v4Routes))
+	for _, r := range t.v4Routes {
+		v4 = append(v4, *r)
+	}
+	v6 = make([]route, 0, len(t.v6Routes))
+	for _, r := range t.v6Routes {
+		v6 = append(v6, *r)
+	}
+	return v4, v6
+}
+
+// Returns the distinct prefixes of the current routes, each of which has a
+// system route if InstallRoutes is enabled.
+func (c *cryptokey) getRoutePrefixes() []string {
+	t := c.routes()
+	prefixes := make([]string, 0, len(t.v4Routes)+len(t.v6Routes))
+	for _, routes := range [][]*route{t.v4Routes, t.v6Routes} {
+		for _, r := range routes {
+			prefixes = append(prefixes, r.prefix.String())
+		}
+	}
+	slices.Sort(prefixes)
+	return slices.Compact(prefixes)
+}
+
+// Returns the keys of all destinations which are currently considered to be
+// unreachable.
+func (c *cryptokey) getUnreachableKeys() []ed25519.PublicKey {
+	var keys []ed25519.PublicKey
+	for _, state := range c.getKeyStates() {
+		if state.down.Load() {
+			keys = append(keys, state.key)
+		}
+	}
+	return keys
+}
+
+// Records that the given key is reachable because a path to it has been
+// found. This doesn't override the prober, since finding a path to a node
+// doesn't mean that it is answering our traffic.
+func (c *cryptokey) setReachable(key ed25519.PublicKey) {
+	state := c.getKeyState(key)
+	if state == nil || state.probe.failed() {
+		return
+	}
+	if state.reachable() {
+		c.log.Infof("CKR destination %s is reachable again", hex.EncodeToString(key))
+	}
+}
+
+// Returns the state of the given destination key, or nil if no routes use it.
+func (c *cryptokey) getKeyState(key ed25519.PublicKey) *keyState {
+	var k keyArray
+	copy(k[:], key)
+	return c.routes().states[k]
+}
+
+// Returns the states of all destination keys that are used by routes, sorted
+// by key.
+func (c *cryptokey) getKeyStates() []*keyState {
+	t := c.routes()
+	states := make([]*keyState, 0, len(t.states))
+	for _, state := range t.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return bytes.Compare(states[i].key, states[j].key) < 0
+	})
+	return states
+}
+
+// Returns how often destinations should be probed, or 0 if they shouldn't.
+func (c *cryptokey) getProbeInterval() time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	if c.config == nil {
+		return 0
+	}
+	return time.Duration(c.config.ProbeInterval) * time.Second
+}
+
+// Returns whether system routes are kept in step with the CKR routes.
+func (c *cryptokey) getInstallRoutes() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.config != nil && c.config.InstallRoutes
+}
+
+// Returns how often the paths to destinations should be looked up, or 0 if
+// they shouldn't.
+func (c *cryptokey) getPathWarmupInterval() time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	if c.config == nil {
+		return 0
+	}
+	return time.Duration(c.config.PathWarmupInterval) * time.Second
+}
+
+// Sorts destinations so that those with the lowest priority values come
+// first. Destinations with the same priority are ordered by key so that the
+// choice between them is stable.
+func sortDestinations(dests []*destination, i, j int) bool {
+	if dests[i].priority != dests[j].priority {
+		return dests[i].priority < dests[j].priority
+	}
+	return bytes.Compare(dests[i].key, dests[j].key) < 0
 }
 
 // Sorts the routes so that the most specific prefixes always come before
-// the less specific ones.
+// the less specific ones, and then by the most specific source. This is only
+// used for presenting the routes, as lookups are performed using the route
+// tries.
 func sortRoutes(route []*route, i, j int) bool {
 	pli, plj := route[i].prefix.Bits(), route[j].prefix.Bits()
 	switch {
@@ -147,40 +945,286 @@ func sortRoutes(route []*route, i, j int) bool {
 		return true
 	case pli < plj:
 		return false
-	default:
+	case route[i].prefix != route[j].prefix:
 		return route[i].prefix.Addr().Less(route[j].prefix.Addr())
+	case route[i].sourceBits() != route[j].sourceBits():
+		return route[i].sourceBits() > route[j].sourceBits()
+	default:
+		return route[i].source.Addr().Less(route[j].source.Addr())
 	}
 }
 
-// Looks up the most specific route for the given address (with the address
-// length specified in bytes) from the crypto-key routing table. An error is
-// returned if the address is not suitable or no route was found.
-func (c *cryptokey) getPublicKeyForAddress(addr netip.Addr) (ed25519.PublicKey, error) {
+// Looks up the most specific route for traffic from the given source address
+// to the given destination address from the crypto-key routing table. If the
+// source address is not valid then only routes for all sources will match.
+func (t *routeTable) lookup(src, addr netip.Addr) (*route, error) {
 	is4, is6 := addr.Is4(), addr.Is6()
 	if is6 && isYggdrasilDestination(addr) {
 		return nil, fmt.Errorf("can't get public key for Yggdrasil route")
 	}
 
-	c.RLock()
-	defer c.RUnlock()
-
-	var routes []*route
+	var route *route
 	switch {
 	case is6:
-		routes = c.v6Routes
+		route = t.v6Trie.lookup(addr, src)
 	case is4:
-		routes = c.v4Routes
+		route = t.v4Trie.lookup(addr, src)
 	default:
 		return nil, fmt.Errorf("unexpected prefix size")
 	}
 
-	for _, route := range routes {
-		if route.prefix.Contains(addr) {
-			return route.destination, nil
+	if route == nil {
+		return nil, fmt.Errorf("%w to %s", errNoRoute, addr)
+	}
+	return route, nil
+}
+
+// Looks up the most specific route for traffic from the source address to the
+// destination address and returns it, along with the destination that the
+// packet should be sent to. An error is returned if the address is not
+// suitable, no route was found or the packet is denied. The packet isn't
+// modified, so if the route has an alias then the destination address of the
+// packet still needs to be translated.
+func (c *cryptokey) getRouteForPacket(src, addr netip.Addr, packet []byte) (*route, *destination, error) {
+	route, err := c.routes().lookup(src, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := route.typ.err(); err != nil {
+		return nil, nil, err
+	}
+	if packet != nil && !c.filter(route, packet, false) {
+		return nil, nil, errPacketDenied
+	}
+	return route, c.selectDestination(route, packet), nil
+}
+
+// Returns the destination that traffic from the source address to the
+// destination address should be sent to, as getRouteForPacket does.
+func (c *cryptokey) getDestinationForAddress(src, addr netip.Addr, packet []byte) (*destination, error) {
+	_, dest, err := c.getRouteForPacket(src, addr, packet)
+	return dest, err
+}
+
+// Looks up the most specific route for the given address that applies to all
+// sources and returns the public key of the destination that traffic should
+// be sent to.
+func (c *cryptokey) getPublicKeyForAddress(addr netip.Addr) (ed25519.PublicKey, error) {
+	dest, err := c.getDestinationForAddress(netip.Addr{}, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return dest.key, nil
+}
+
+// Returns the destination of the route that the packet should be sent to.
+// This is chosen from the most preferred priority which has any reachable
+// destinations, spreading flows across them according to their weights. If
+// none of the destinations are reachable then the most preferred one is used
+// anyway.
+func (c *cryptokey) selectDestination(r *route, packet []byte) *destination {
+	if len(r.destinations) == 1 {
+		return r.destinations[0]
+	}
+	now := time.Now()
+	for i := 0; i < len(r.destinations); {
+		j := i + 1
+		for j < len(r.destinations) && r.destinations[j].priority == r.destinations[i].priority {
+			j++
+		}
+		if d := c.selectFromGroup(r.destinations[i:j], packet, now); d != nil {
+			return d
+		}
+		i = j
+	}
+	return r.destinations[0]
+}
+
+// Returns the reachable destination from a group of destinations with the
+// same priority that has the highest score for the packet's flow, or nil if
+// none of them are reachable.
+func (c *cryptokey) selectFromGroup(group []*destination, packet []byte, now time.Time) *destination {
+	var flow uint64
+	if len(group) > 1 {
+		flow = flowHash(packet)
+	}
+	var best *destination
+	var bestScore float64
+	for _, d := range group {
+		down, changed := d.state.isDown(now)
+		if changed {
+			c.log.Warnf("CKR destination %s is not responding, failing over", hex.EncodeToString(d.key))
+		}
+		if down {
+			continue
+		}
+		if score := d.score(flow); best == nil || score > bestScore {
+			best, bestScore = d, score
+		}
+	}
+	return best
+}
+
+// Checks whether traffic from the source address to the destination address
+// is allowed to come from the node with the given key. In strict mode the key
+// must be one of the destinations of the route that replies would take, in
+// loose mode there must be a route for the source via any node, and otherwise
+// the key must be used by any route. If so then the node is also marked as
+// reachable, and the packet, if given, is checked against the rules of the
+// route for the source. Rejected packets are counted by reason.
+func (c *cryptokey) isValidSource(addr, dst netip.Addr, key ed25519.PublicKey, packet []byte) (valid, allowed bool) {
+	t := c.routes()
+	route, err := t.lookup(dst, addr)
+	if err == nil && route.typ != routeForward {
+		// Replies would not be sent anywhere.
+		route, err = nil, route.typ.err()
+	}
+	mode := t.rpf
+	if err == nil && route.rpf != rpfDefault {
+		mode = route.rpf
+	}
+	if mode == rpfDefault {
+		mode = rpfStrict
+	}
+	var state *keyState
+	if err == nil {
+		for _, d := range route.destinations {
+			if d.key.Equal(key) {
+				state = d.state
+				break
+			}
 		}
 	}
+	if state == nil {
+		switch {
+		case mode == rpfStrict && err != nil, mode == rpfLoose && err != nil:
+			c.rejected.add(rejectNoRoute)
+			return false, false
+		case mode == rpfStrict:
+			c.rejected.add(rejectWrongKey)
+			return false, false
+		}
+		var k keyArray
+		copy(k[:], key)
+		if state = t.states[k]; state == nil {
+			c.rejected.add(rejectUnknownKey)
+			return false, false
+		}
+	}
+	if state.probe.missed.Load() != 0 {
+		// Only written when set, so that readers using the same key don't
+		// keep writing to the same memory.
+		state.probe.missed.Store(0)
+	}
+	if state.reachable() {
+		c.log.Infof("CKR destination %s is reachable again", hex.EncodeToString(state.key))
+	}
+	if packet != nil && route != nil && !c.filter(route, packet, true) {
+		c.rejected.add(rejectDenied)
+		return true, false
+	}
+	return true, true
+}
+
+// Sets the masquerade addresses from the configuration, or disables
+// masquerading if it isn't enabled.
+func (c *cryptokey) setMasquerade(config *config.TunnelRoutingConfig) {
+	var v4, v6 netip.Addr
+	local := interfaceAddresses(config.Addresses)
+	if config.Masquerade {
+		if v4, v6 = masqueradeAddresses(local); !v4.IsValid() && !v6.IsValid() {
+			c.log.Warnln("Masquerade is enabled but there are no Addresses to use")
+		}
+	}
+	c.nat.setAddresses(v4, v6, local)
+}
 
-	return nil, fmt.Errorf("no route to %s", addr.String())
+// Checks the packet against the route's rules and, for stateful routes,
+// the connection tracking table. Outbound packets that are allowed are
+// recorded in the connection tracking table.
+func (c *cryptokey) filter(r *route, packet []byte, inbound bool) bool {
+	if len(r.rules) == 0 && !r.stateful {
+		return true
+	}
+	f, ok := parsePacketFields(packet)
+	if !ok || !r.allows(&f, inbound) {
+		return false
+	}
+	if r.stateful {
+		if inbound {
+			return c.conntrack.inbound(&f, packet, time.Now())
+		}
+		c.conntrack.outbound(&f, packet, time.Now())
+	}
+	return true
+}
+
+// Sets the Yggdrasil prefixes that are allowed when YggdrasilRouting is
+// disabled from the configuration.
+func (c *cryptokey) setYggdrasilAllowed(config *config.TunnelRoutingConfig) {
+	prefixes, errs := parseYggdrasilAllowed(config.YggdrasilAllowed)
+	for _, err := range errs {
+		c.log.Warnf("Error in YggdrasilAllowed: %s", err)
+	}
+	c.yggdrasilAllowed.Store(&prefixes)
+}
+
+// Parses a list of public keys and Yggdrasil prefixes or addresses. Keys are
+// converted to the address and subnet of the node.
+func parseYggdrasilAllowed(entries []string) ([]netip.Prefix, []error) {
+	var prefixes []netip.Prefix
+	var errs []error
+	for _, entry := range entries {
+		if key, err := hex.DecodeString(entry); err == nil && len(key) == ed25519.PublicKeySize {
+			addr := address.AddrForKey(key)
+			snet := address.SubnetForKey(key)
+			subnet := append(snet[:], make([]byte, 8)...)
+			prefixes = append(prefixes,
+				netip.PrefixFrom(netip.AddrFrom16(*addr), 128),
+				netip.PrefixFrom(netip.AddrFrom16([16]byte(subnet)), 64),
+			)
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(entry)
+			if aerr != nil {
+				errs = append(errs, fmt.Errorf("%q is not a public key, prefix or address", entry))
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if !prefix.Addr().Is6() || !isYggdrasilDestination(prefix.Addr()) {
+			errs = append(errs, fmt.Errorf("%q is not in the Yggdrasil address range", entry))
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, errs
+}
+
+// Returns whether any Yggdrasil addresses are allowed when YggdrasilRouting
+// is disabled.
+func (c *cryptokey) hasYggdrasilAllowed() bool {
+	prefixes := c.yggdrasilAllowed.Load()
+	return prefixes != nil && len(*prefixes) > 0
+}
+
+// Returns whether native Yggdrasil traffic to or from the address is allowed,
+// either because YggdrasilRouting is enabled or because the address is in
+// one of the allowed prefixes.
+func (c *cryptokey) isYggdrasilAllowed(addr netip.Addr) bool {
+	if c.yggdrasilRouting.Load() {
+		return true
+	}
+	if prefixes := c.yggdrasilAllowed.Load(); prefixes != nil {
+		for _, prefix := range *prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func isYggdrasilDestination(ip netip.Addr) bool {
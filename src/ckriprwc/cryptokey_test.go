@@ -0,0 +1,937 @@
+package ckriprwc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	iwt "github.com/Arceliar/ironwood/types"
+	"github.com/gologme/log"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"github.com/neilalexander/yggdrasilckr/src/config"
+)
+
+func testKey(i int) string {
+	var key [ed25519.PublicKeySize]byte
+	binary.BigEndian.PutUint64(key[:], uint64(i)+1)
+	return hex.EncodeToString(key[:])
+}
+
+func randomPrefix(rng *rand.Rand, is4 bool) netip.Prefix {
+	if is4 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], rng.Uint32())
+		return netip.PrefixFrom(netip.AddrFrom4(b), 8+rng.Intn(25)).Masked()
+	}
+	var b [16]byte
+	b[0] = 0x20 // Keep clear of the Yggdrasil range
+	binary.BigEndian.PutUint64(b[1:9], rng.Uint64())
+	binary.BigEndian.PutUint64(b[8:], rng.Uint64())
+	return netip.PrefixFrom(netip.AddrFrom16(b), 16+rng.Intn(113)).Masked()
+}
+
+func randomAddrIn(rng *rand.Rand, prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		if rng.Intn(2) == 1 {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func buildTestCryptokey(rng *rand.Rand, n int, is4 bool) (*cryptokey, []netip.Prefix) {
+	c := &cryptokey{}
+	prefixes := make([]netip.Prefix, 0, n)
+	for i := 0; len(prefixes) < n; i++ {
+		prefix := randomPrefix(rng, is4)
+		if c._getRoute(routeKey{prefix: prefix}) != nil {
+			continue
+		}
+		if _, err := c._addRemoteSubnet(prefix.String(), "", testKey(i), 0, 1); err != nil {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	c._publish()
+	return c, prefixes
+}
+
+// Returns the route that the old linear scan over the sorted route slices
+// would have chosen, for comparison with the trie.
+func linearLookup(routes []*route, addr netip.Addr) *route {
+	var best *route
+	for _, r := range routes {
+		if r.prefix.Contains(addr) && (best == nil || r.prefix.Bits() > best.prefix.Bits()) {
+			best = r
+		}
+	}
+	return best
+}
+
+func TestRouteTrieLongestMatch(t *testing.T) {
+	for _, is4 := range []bool{true, false} {
+		rng := rand.New(rand.NewSource(1))
+		c, prefixes := buildTestCryptokey(rng, 2000, is4)
+		routes := c.v6Routes
+		if is4 {
+			routes = c.v4Routes
+		}
+		for i := 0; i < 20000; i++ {
+			addr := randomAddrIn(rng, prefixes[rng.Intn(len(prefixes))])
+			want := linearLookup(routes, addr)
+			key, err := c.getPublicKeyForAddress(addr)
+			if err != nil {
+				t.Fatalf("no route for %s, want %s", addr, want.prefix)
+			}
+			if !key.Equal(want.destinations[0].key) {
+				t.Fatalf("wrong route for %s, want %s", addr, want.prefix)
+			}
+		}
+	}
+}
+
+func TestRouteTrieNested(t *testing.T) {
+	c := &cryptokey{}
+	for i, cidr := range []string{
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.0/24",
+		"10.1.2.128/25",
+		"10.1.3.0/24",
+		"0.0.0.0/0",
+	} {
+		if _, err := c._addRemoteSubnet(cidr, "", testKey(i), 0, 1); err != nil {
+			t.Fatalf("_addRemoteSubnet(%s): %v", cidr, err)
+		}
+	}
+	if _, err := c._addRemoteSubnet("10.1.2.5/24", "", testKey(2), 0, 1); err == nil {
+		t.Fatal("expected duplicate destination to be rejected")
+	}
+	c._publish()
+	for addr, want := range map[string]int{
+		"10.1.2.200": 3,
+		"10.1.2.1":   2,
+		"10.1.3.1":   4,
+		"10.1.4.1":   1,
+		"10.2.0.1":   0,
+		"192.0.2.1":  5,
+	} {
+		key, err := c.getPublicKeyForAddress(netip.MustParseAddr(addr))
+		if err != nil {
+			t.Fatalf("getPublicKeyForAddress(%s): %v", addr, err)
+		}
+		if got := hex.EncodeToString(key); got != testKey(want) {
+			t.Fatalf("getPublicKeyForAddress(%s) = %s, want %s", addr, got, testKey(want))
+		}
+	}
+	if _, err := c.getPublicKeyForAddress(netip.MustParseAddr("2001:db8::1")); err == nil {
+		t.Fatal("expected no IPv6 route")
+	}
+}
+
+func TestSourceSpecificRoutes(t *testing.T) {
+	c := &cryptokey{}
+	for i, r := range []struct{ cidr, source string }{
+		{"0.0.0.0/0", ""},
+		{"0.0.0.0/0", "192.168.1.0/24"},
+		{"0.0.0.0/0", "192.168.0.0/16"},
+		{"10.0.0.0/8", "192.168.2.0/24"},
+	} {
+		if _, err := c._addRemoteSubnet(r.cidr, r.source, testKey(i), 0, 1); err != nil {
+			t.Fatalf("_addRemoteSubnet(%s from %s): %v", r.cidr, r.source, err)
+		}
+	}
+	if _, err := c._addRemoteSubnet("0.0.0.0/0", "2001:db8::/32", testKey(4), 0, 1); err == nil {
+		t.Fatal("expected a source of a different address family to be rejected")
+	}
+	c._publish()
+	for _, tc := range []struct {
+		src, dst string
+		want     int
+	}{
+		{"192.168.1.5", "198.51.100.1", 1},
+		{"192.168.3.1", "198.51.100.1", 2},
+		{"172.16.0.1", "198.51.100.1", 0},
+		{"192.168.2.1", "10.1.1.1", 3},
+		{"192.168.1.5", "10.1.1.1", 1}, // Falls back to the shorter prefix
+	} {
+		dest, err := c.getDestinationForAddress(netip.MustParseAddr(tc.src), netip.MustParseAddr(tc.dst), nil)
+		if err != nil {
+			t.Fatalf("getDestinationForAddress(%s, %s): %v", tc.src, tc.dst, err)
+		}
+		if got := hex.EncodeToString(dest.key); got != testKey(tc.want) {
+			t.Fatalf("getDestinationForAddress(%s, %s) = %s, want %s", tc.src, tc.dst, got, testKey(tc.want))
+		}
+	}
+
+	// Replies are only accepted from the node that traffic is sent to.
+	src, dst := netip.MustParseAddr("198.51.100.1"), netip.MustParseAddr("192.168.1.5")
+	for i, want := range []bool{false, true, false} {
+		bpk, _ := hex.DecodeString(testKey(i))
+		if got, _ := c.isValidSource(src, dst, bpk, nil); got != want {
+			t.Fatalf("isValidSource via %d = %v, want %v", i, got, want)
+		}
+	}
+
+	// Removing a source-specific route leaves the others in place.
+	if removed, err := c._removeRemoteSubnet("0.0.0.0/0", "192.168.1.0/24", ""); err != nil || removed {
+		t.Fatalf("_removeRemoteSubnet = %v, %v", removed, err)
+	}
+	c._rebuildTries()
+	c._publish()
+	dest, _ := c.getDestinationForAddress(netip.MustParseAddr("192.168.1.5"), netip.MustParseAddr("198.51.100.1"), nil)
+	if got := hex.EncodeToString(dest.key); got != testKey(2) {
+		t.Fatalf("expected the less specific source to be used, got %s", got)
+	}
+}
+
+func TestReversePathFilter(t *testing.T) {
+	c := &cryptokey{log: log.New(io.Discard, "", 0)}
+	cfg := &config.TunnelRoutingConfig{
+		RemoteSubnets: map[string][]string{testKey(0): {"10.0.0.0/8"}},
+		Routes: []config.RouteConfig{{
+			Subnet:            "172.16.0.0/12",
+			Destinations:      []config.RouteDestinationConfig{{Key: testKey(1)}},
+			ReversePathFilter: "loose",
+		}},
+	}
+	_ = c.configure(cfg)
+	keys := make([]ed25519.PublicKey, 3)
+	for i := range keys {
+		keys[i], _ = hex.DecodeString(testKey(i))
+	}
+	check := func(src string, key int, want bool) {
+		t.Helper()
+		if valid, _ := c.isValidSource(netip.MustParseAddr(src), netip.Addr{}, keys[key], nil); valid != want {
+			t.Fatalf("isValidSource(%s) via %d = %v, want %v", src, key, valid, want)
+		}
+	}
+	check("10.1.1.1", 0, true)
+	check("10.1.1.1", 1, false)
+	check("172.16.1.1", 0, true)
+	check("192.0.2.1", 0, false)
+
+	next := *cfg
+	next.ReversePathFilter = "off"
+	c.reconfigure(&next)
+	check("10.1.1.1", 1, true)
+	check("192.0.2.1", 0, true)
+	check("192.0.2.1", 2, false)
+
+	rejected := c.rejected.get()
+	for reason, want := range map[string]uint64{"wrong_key": 1, "no_route": 1, "unknown_key": 1, "denied": 0} {
+		if rejected[reason] != want {
+			t.Fatalf("rejected %s = %d, want %d", reason, rejected[reason], want)
+		}
+	}
+}
+
+func TestRouteTypes(t *testing.T) {
+	c := &cryptokey{log: log.New(io.Discard, "", 0)}
+	_ = c.configure(&config.TunnelRoutingConfig{
+		RemoteSubnets: map[string][]string{testKey(0): {"10.0.0.0/8"}},
+		Routes: []config.RouteConfig{
+			{Subnet: "10.1.0.0/16", Type: "blackhole"},
+			{Subnet: "10.2.0.0/16", Type: "unreachable"},
+			{Subnet: "10.3.0.0/16", Type: "prohibit"},
+			{Subnet: "10.4.0.0/16", Type: "prohibit", Destinations: []config.RouteDestinationConfig{{Key: testKey(1)}}},
+			{Subnet: "10.5.0.0/16", Type: "bogus"},
+		},
+	})
+	for addr, want := range map[string]error{
+		"10.0.0.1": nil,
+		"10.1.0.1": errRouteBlackhole,
+		"10.2.0.1": errRouteUnreachable,
+		"10.3.0.1": errRouteProhibit,
+		"10.4.0.1": nil,
+		"10.5.0.1": nil,
+	} {
+		if _, err := c.getPublicKeyForAddress(netip.MustParseAddr(addr)); !errors.Is(err, want) {
+			t.Fatalf("getPublicKeyForAddress(%s) = %v, want %v", addr, err, want)
+		}
+	}
+
+	// Traffic from typed prefixes is never accepted.
+	key, _ := hex.DecodeString(testKey(0))
+	if valid, _ := c.isValidSource(netip.MustParseAddr("10.1.0.1"), netip.Addr{}, key, nil); valid {
+		t.Fatal("expected a source in a blackhole route to be rejected")
+	}
+
+	// Destinations can't be added to typed routes at runtime.
+	if _, err := c.addRemoteSubnet("10.1.0.0/16", "", testKey(1), 0, 0); err == nil {
+		t.Fatal("expected adding a destination to a blackhole route to fail")
+	}
+}
+
+func TestRouteFailover(t *testing.T) {
+	c := &cryptokey{log: log.New(io.Discard, "", 0)}
+	for i, priority := range []int{10, 0} {
+		if _, err := c._addRemoteSubnet("10.0.0.0/8", "", testKey(i), priority, 1); err != nil {
+			t.Fatalf("_addRemoteSubnet: %v", err)
+		}
+	}
+	c._publish()
+	addr := netip.MustParseAddr("10.1.2.3")
+	preferred, standby := testKey(1), testKey(0)
+	expect := func(want string) {
+		t.Helper()
+		key, err := c.getPublicKeyForAddress(addr)
+		if err != nil {
+			t.Fatalf("getPublicKeyForAddress: %v", err)
+		}
+		if got := hex.EncodeToString(key); got != want {
+			t.Fatalf("getPublicKeyForAddress = %s, want %s", got, want)
+		}
+	}
+
+	expect(preferred)
+	dest, _ := c.getDestinationForAddress(netip.Addr{}, addr, nil)
+	dest.state.sent(time.Now().Add(-failoverTimeout / 2))
+	expect(preferred)
+
+	// Nothing has come back from the preferred destination for too long.
+	dest.state.unanswered.Store(time.Now().Add(-failoverTimeout).UnixNano())
+	expect(standby)
+
+	// Return traffic from either destination is accepted.
+	for _, k := range []string{preferred, standby} {
+		bpk, _ := hex.DecodeString(k)
+		if valid, _ := c.isValidSource(addr, netip.Addr{}, bpk, nil); !valid {
+			t.Fatalf("expected traffic from %s to be accepted", k)
+		}
+	}
+	bpk, _ := hex.DecodeString(testKey(2))
+	if valid, _ := c.isValidSource(addr, netip.Addr{}, bpk, nil); valid {
+		t.Fatal("expected traffic from an unlisted key to be rejected")
+	}
+
+	// Having heard from the preferred destination, traffic moves back.
+	expect(preferred)
+	if keys := c.getUnreachableKeys(); len(keys) != 0 {
+		t.Fatalf("expected no unreachable keys, got %d", len(keys))
+	}
+}
+
+func TestProbeFailover(t *testing.T) {
+	k := testReadWriteCloser()
+	conn := k.conn.(*fakeConn)
+	_ = k.ckr.configure(&config.TunnelRoutingConfig{
+		Routes: []config.RouteConfig{{
+			Subnet:       "10.0.0.0/8",
+			Destinations: []config.RouteDestinationConfig{{Key: testKey(0)}, {Key: testKey(1), Priority: 1}},
+		}},
+	})
+	addr := netip.MustParseAddr("10.1.2.3")
+	expect := func(want string) {
+		t.Helper()
+		key, err := k.ckr.getPublicKeyForAddress(addr)
+		if err != nil {
+			t.Fatalf("getPublicKeyForAddress: %v", err)
+		}
+		if got := hex.EncodeToString(key); got != want {
+			t.Fatalf("getPublicKeyForAddress = %s, want %s", got, want)
+		}
+	}
+	state := k.ckr.getKeyState(testPublicKey(0))
+	probe := func() []byte {
+		t.Helper()
+		k.sendProbe(state)
+		written := conn.takeWritten()
+		if len(written) != 1 || len(written[0].data) != probeMessageSize || written[0].data[0] != controlProbeRequest || !bytes.Equal(written[0].addr.(iwt.Addr), testPublicKey(0)) {
+			t.Fatalf("unexpected probe %+v", written)
+		}
+		return written[0].data
+	}
+	response := func(request []byte) []byte {
+		msg := append([]byte(nil), request...)
+		msg[0] = controlProbeResponse
+		return msg
+	}
+
+	// The destination is used until enough probes in a row have gone
+	// unanswered, and then traffic fails over.
+	var requests [][]byte
+	for range probeLossThreshold + 1 {
+		expect(testKey(0))
+		requests = append(requests, probe())
+	}
+	expect(testKey(1))
+	if !state.probe.failed() {
+		t.Fatal("expected the probes to have failed")
+	}
+
+	// Replies that are malformed, unsolicited or to earlier probes are
+	// ignored.
+	last := response(requests[len(requests)-1])
+	zero := response(requests[0])
+	binary.BigEndian.PutUint64(zero[1:], 0)
+	for _, reply := range []struct {
+		msg  []byte
+		from ed25519.PublicKey
+	}{
+		{last[:probeMessageSize-1], testPublicKey(0)},
+		{response(requests[0]), testPublicKey(0)},
+		{zero, testPublicKey(0)},
+		{last, testPublicKey(1)},
+		{last, testPublicKey(2)},
+	} {
+		k.handleControl(reply.msg, reply.from)
+	}
+	expect(testKey(1))
+	if state.probe.missed.Load() != probeLossThreshold || state.probe.lastReply.Load() != 0 {
+		t.Fatal("expected the probe state to be unchanged")
+	}
+
+	// Answering the outstanding probe brings the destination back, but only
+	// once.
+	k.handleControl(last, testPublicKey(0))
+	expect(testKey(0))
+	if state.probe.missed.Load() != 0 || state.probe.lastReply.Load() == 0 || state.probe.rtt.Load() < 0 {
+		t.Fatal("expected the probe to be answered")
+	}
+	state.probe.missed.Store(1)
+	k.handleControl(last, testPublicKey(0))
+	if state.probe.missed.Load() != 1 {
+		t.Fatal("expected a repeated reply to be ignored")
+	}
+}
+
+func TestRouteLoadBalancing(t *testing.T) {
+	c := &cryptokey{log: log.New(io.Discard, "", 0)}
+	for i, weight := range []int{1, 3} {
+		if _, err := c._addRemoteSubnet("0.0.0.0/0", "", testKey(i), 0, weight); err != nil {
+			t.Fatalf("_addRemoteSubnet: %v", err)
+		}
+	}
+	if _, err := c._addRemoteSubnet("0.0.0.0/0", "", testKey(2), 1, 1); err != nil {
+		t.Fatalf("_addRemoteSubnet: %v", err)
+	}
+	c._publish()
+	addr := netip.MustParseAddr("198.51.100.1")
+	const flows = 4000
+	chosen := make([]*destination, flows)
+	counts := map[string]int{}
+	for i := range chosen {
+		packet := testTCPPacket("10.0.0.1", "198.51.100.1", uint16(1024+i), 443, 0x10)
+		dest, err := c.getDestinationForAddress(netip.Addr{}, addr, packet)
+		if err != nil {
+			t.Fatalf("getDestinationForAddress: %v", err)
+		}
+		if again, _ := c.getDestinationForAddress(netip.Addr{}, addr, packet); again != dest {
+			t.Fatal("expected the same flow to use the same destination")
+		}
+		chosen[i] = dest
+		counts[hex.EncodeToString(dest.key)]++
+	}
+	if n := counts[testKey(2)]; n != 0 {
+		t.Fatalf("lower priority destination used for %d flows", n)
+	}
+	if n := counts[testKey(1)]; n < flows*2/3 || n > flows*5/6 {
+		t.Fatalf("destination with weight 3 used for %d of %d flows", n, flows)
+	}
+
+	// When one destination goes down, only its flows should move.
+	down := chosen[0]
+	down.state.unanswered.Store(time.Now().Add(-failoverTimeout).UnixNano())
+	for i, before := range chosen {
+		packet := testTCPPacket("10.0.0.1", "198.51.100.1", uint16(1024+i), 443, 0x10)
+		after, _ := c.getDestinationForAddress(netip.Addr{}, addr, packet)
+		switch {
+		case before == down && after == down:
+			t.Fatal("expected flow to move away from unreachable destination")
+		case before != down && after != before:
+			t.Fatal("expected flow on a reachable destination to stay put")
+		}
+	}
+}
+
+func TestRouteRules(t *testing.T) {
+	c := &cryptokey{log: log.New(io.Discard, "", 0)}
+	_ = c.configure(&config.TunnelRoutingConfig{
+		Routes: []config.RouteConfig{{
+			Subnet:       "172.16.0.0/12",
+			Destinations: []config.RouteDestinationConfig{{Key: testKey(0)}},
+			Rules: []config.RuleConfig{
+				{Action: "deny", Protocol: "tcp", LocalSubnet: "10.1.9.0/24"},
+				{Action: "allow", Protocol: "tcp", LocalSubnet: "10.1.0.0/16", LocalPorts: []string{"443"}},
+				{Action: "allow", Protocol: "icmp", LocalSubnet: "10.1.0.0/16", ICMPTypes: []int{0, 8}},
+			},
+		}},
+	})
+	key, _ := hex.DecodeString(testKey(0))
+	for _, tc := range []struct {
+		name    string
+		packet  []byte
+		inbound bool
+		want    bool
+	}{
+		{"inbound https", testTCPPacket("172.16.0.5", "10.1.2.3", 50000, 443, 0x10), true, true},
+		{"outbound https reply", testTCPPacket("10.1.2.3", "172.16.0.5", 443, 50000, 0x10), false, true},
+		{"inbound ssh", testTCPPacket("172.16.0.5", "10.1.2.3", 50000, 22, 0x10), true, false},
+		{"inbound https to denied subnet", testTCPPacket("172.16.0.5", "10.1.9.1", 50000, 443, 0x10), true, false},
+		{"inbound https outside subnet", testTCPPacket("172.16.0.5", "10.2.0.1", 50000, 443, 0x10), true, false},
+		{"outbound http", testTCPPacket("10.1.2.3", "172.16.0.5", 40000, 80, 0x10), false, false},
+		{"inbound ping", testICMPPacket("172.16.0.5", "10.1.2.3", 8, 0), true, true},
+		{"inbound redirect", testICMPPacket("172.16.0.5", "10.1.2.3", 5, 0), true, false},
+	} {
+		f, _ := parsePacketFields(tc.packet)
+		var allowed bool
+		if tc.inbound {
+			var valid bool
+			valid, allowed = c.isValidSource(f.src, f.dst, key, tc.packet)
+			if !valid {
+				t.Fatalf("%s: expected the source to be valid", tc.name)
+			}
+		} else {
+			_, err := c.getDestinationForAddress(f.src, f.dst, tc.packet)
+			switch {
+			case err == nil:
+				allowed = true
+			case !errors.Is(err, errPacketDenied):
+				t.Fatalf("%s: getDestinationForAddress: %v", tc.name, err)
+			}
+		}
+		if allowed != tc.want {
+			t.Fatalf("%s: allowed = %v, want %v", tc.name, allowed, tc.want)
+		}
+	}
+}
+
+func TestStatefulRoutes(t *testing.T) {
+	c := &cryptokey{log: log.New(io.Discard, "", 0)}
+	_ = c.configure(&config.TunnelRoutingConfig{
+		Routes: []config.RouteConfig{{
+			Subnet:       "172.16.0.0/12",
+			Destinations: []config.RouteDestinationConfig{{Key: testKey(0)}},
+			Stateful:     true,
+		}},
+		ConntrackMaxEntries: 2,
+	})
+	key, _ := hex.DecodeString(testKey(0))
+	inbound := func(packet []byte) bool {
+		f, _ := parsePacketFields(packet)
+		valid, allowed := c.isValidSource(f.src, f.dst, key, packet)
+		return valid && allowed
+	}
+	outbound := func(packet []byte) {
+		f, _ := parsePacketFields(packet)
+		if _, err := c.getDestinationForAddress(f.src, f.dst, packet); err != nil {
+			t.Fatalf("getDestinationForAddress: %v", err)
+		}
+	}
+
+	if inbound(testTCPPacket("172.16.0.5", "10.1.2.3", 50000, 22, 0x02)) {
+		t.Fatal("expected an unsolicited inbound connection to be denied")
+	}
+	outbound(testTCPPacket("10.1.2.3", "172.16.0.5", 40000, 443, 0x02))
+	if !inbound(testTCPPacket("172.16.0.5", "10.1.2.3", 443, 40000, 0x12)) {
+		t.Fatal("expected the reply to be accepted")
+	}
+	if inbound(testTCPPacket("172.16.0.5", "10.1.2.3", 443, 40001, 0x12)) {
+		t.Fatal("expected a reply to a different port to be denied")
+	}
+	flows := c.conntrack.getFlows(time.Now())
+	if len(flows) != 1 || flows[0].state != flowEstablished || flows[0].packetsIn != 1 {
+		t.Fatalf("unexpected flows %+v", flows)
+	}
+
+	// The table only holds two flows, so starting two more evicts the first.
+	outbound(testTCPPacket("10.1.2.3", "172.16.0.5", 40001, 443, 0x02))
+	outbound(testTCPPacket("10.1.2.3", "172.16.0.5", 40002, 443, 0x02))
+	if inbound(testTCPPacket("172.16.0.5", "10.1.2.3", 443, 40000, 0x10)) {
+		t.Fatal("expected the evicted flow to be denied")
+	}
+	if !inbound(testTCPPacket("172.16.0.5", "10.1.2.3", 443, 40002, 0x12)) {
+		t.Fatal("expected the newest flow to be accepted")
+	}
+
+	// Replies stop being accepted once the flow has expired.
+	c.conntrack.expire(time.Now().Add(conntrackTCPSynSentTimeout + time.Second))
+	if inbound(testTCPPacket("172.16.0.5", "10.1.2.3", 443, 40001, 0x12)) {
+		t.Fatal("expected the expired flow to be denied")
+	}
+	if n := len(c.conntrack.getFlows(time.Now())); n != 1 {
+		t.Fatalf("expected only the established flow to remain, got %d", n)
+	}
+}
+
+func TestAliasRoutes(t *testing.T) {
+	k := testReadWriteCloser()
+	c := &k.ckr
+	_ = c.configure(&config.TunnelRoutingConfig{
+		Routes: []config.RouteConfig{
+			{Subnet: "192.168.1.0/24", Alias: "10.200.5.0/24", Destinations: []config.RouteDestinationConfig{{Key: testKey(0)}}},
+			{Subnet: "192.168.1.0/24", Alias: "10.200.6.0/24", Destinations: []config.RouteDestinationConfig{{Key: testKey(1)}}},
+		},
+	})
+	key := testPublicKey(1)
+
+	// The packet is translated in a copy, leaving the caller's buffer alone.
+	packet := testTCPPacket("10.1.2.3", "10.200.6.7", 40000, 22, 0x02)
+	if _, err := k.writePC(packet); err != nil {
+		t.Fatalf("writePC: %v", err)
+	}
+	written := k.conn.(*fakeConn).takeWritten()
+	if len(written) != 1 || !bytes.Equal(written[0].addr.(iwt.Addr), key) {
+		t.Fatalf("expected the packet to be sent to %s", testKey(1))
+	}
+	if f, _ := parsePacketFields(written[0].data); f.dst.String() != "192.168.1.7" || !validChecksums(written[0].data) {
+		t.Fatalf("unexpected translated destination %s", f.dst)
+	}
+	if !bytes.Equal(packet, testTCPPacket("10.1.2.3", "10.200.6.7", 40000, 22, 0x02)) {
+		t.Fatal("expected the original packet not to be modified")
+	}
+
+	reply := testTCPPacket("192.168.1.7", "10.1.2.3", 22, 40000, 0x12)
+	src := netip.MustParseAddr("192.168.1.7")
+	if !c.translateInbound(reply, src, key) {
+		t.Fatal("expected the reply to be translated")
+	}
+	f, _ := parsePacketFields(reply)
+	if f.src.String() != "10.200.6.7" || !validChecksums(reply) {
+		t.Fatalf("unexpected translated source %s", f.src)
+	}
+	if valid, _ := c.isValidSource(f.src, f.dst, key, nil); !valid {
+		t.Fatal("expected the translated source to be valid")
+	}
+
+	// An ICMP error from a router outside of the remote prefix has the packet
+	// that it quotes translated back, but keeps its own source.
+	exceeded, _ := CreateICMPv4(net.ParseIP("10.1.2.3"), net.ParseIP("172.16.0.1"), ipv4.ICMPTypeTimeExceeded, 0, &icmp.TimeExceeded{Data: written[0].data})
+	if !c.translateInbound(exceeded, netip.MustParseAddr("172.16.0.1"), key) {
+		t.Fatal("expected the error to be translated")
+	}
+	fe, _ := parsePacketFields(exceeded)
+	inner := exceeded[fe.transport+8:]
+	_, sum := packetSums(exceeded)
+	if fi, _ := parsePacketFields(inner); fe.src.String() != "172.16.0.1" || fi.dst.String() != "10.200.6.7" || sum != 0xffff || !validChecksums(inner) {
+		t.Fatalf("unexpected error translation %s about %s", fe.src, fi.dst)
+	}
+
+	// Packets from other nodes aren't translated.
+	other := testTCPPacket("192.168.1.7", "10.1.2.3", 22, 40000, 0x12)
+	if !c.translateInbound(other, src, testPublicKey(2)) || !bytes.Equal(other, testTCPPacket("192.168.1.7", "10.1.2.3", 22, 40000, 0x12)) {
+		t.Fatal("expected the packet from another node to be left alone")
+	}
+
+	// The example from RFC 6296 section 3.7.
+	internal := netip.MustParsePrefix("fd01:203:405::/48")
+	external := netip.MustParsePrefix("2001:db8:1::/48")
+	addr := netip.MustParseAddr("fd01:203:405:1::1234")
+	mapped, ok := mapAddress(addr, internal, external)
+	if !ok || mapped != netip.MustParseAddr("2001:db8:1:d550::1234") {
+		t.Fatalf("mapAddress = %s, %v", mapped, ok)
+	}
+	if back, ok := mapAddress(mapped, external, internal); !ok || back != addr {
+		t.Fatalf("mapAddress = %s, %v, want %s", back, ok, addr)
+	}
+
+	for _, alias := range []string{"10.200.7.0/25", "fd00::/24", "192.168.0.0/16"} {
+		if _, _, err := parseAlias("192.168.1.0/24", alias); err == nil {
+			t.Fatalf("expected alias %s to be rejected", alias)
+		}
+	}
+}
+
+func TestYggdrasilAllowed(t *testing.T) {
+	prefixes, errs := parseYggdrasilAllowed([]string{testKey(0), "300:1111:2222:3333::/64", "201:abcd::1", "fd00::/8", "nonsense"})
+	if len(prefixes) != 4 || len(errs) != 2 {
+		t.Fatalf("parseYggdrasilAllowed = %v, %v", prefixes, errs)
+	}
+
+	c := &cryptokey{log: log.New(io.Discard, "", 0)}
+	_ = c.configure(&config.TunnelRoutingConfig{
+		YggdrasilAllowed: []string{"300:1111:2222:3333::/64", "201:abcd::1"},
+	})
+	if !c.hasYggdrasilAllowed() {
+		t.Fatal("expected some Yggdrasil addresses to be allowed")
+	}
+	for addr, want := range map[string]bool{
+		"300:1111:2222:3333::1": true,
+		"201:abcd::1":           true,
+		"201:abcd::2":           false,
+		"300:1111:2222:4444::1": false,
+	} {
+		if got := c.isYggdrasilAllowed(netip.MustParseAddr(addr)); got != want {
+			t.Fatalf("isYggdrasilAllowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	c.reconfigure(&config.TunnelRoutingConfig{YggdrasilRouting: true})
+	if c.hasYggdrasilAllowed() || !c.isYggdrasilAllowed(netip.MustParseAddr("201:abcd::2")) {
+		t.Fatal("expected all Yggdrasil addresses to be allowed by YggdrasilRouting")
+	}
+}
+
+func TestYggdrasilFirewall(t *testing.T) {
+	c := &cryptokey{log: log.New(io.Discard, "", 0)}
+	_ = c.configure(&config.TunnelRoutingConfig{
+		YggdrasilRouting: true,
+		YggdrasilFirewall: config.YggdrasilFirewallConfig{
+			Enabled: true,
+			Rules: []config.YggdrasilFirewallRuleConfig{
+				{Action: "deny", Sources: []string{"300:1111:2222:3333::5"}},
+				{Sources: []string{"300:1111:2222:3333::/64"}, Protocol: "tcp", LocalPorts: []string{"22"}},
+			},
+		},
+	})
+	const local = "201:abcd::1"
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{"ssh from allowed prefix", testTCPPacket("300:1111:2222:3333::1", local, 50000, 22, 0x02), true},
+		{"ssh from denied address", testTCPPacket("300:1111:2222:3333::5", local, 50000, 22, 0x02), false},
+		{"ssh from elsewhere", testTCPPacket("300:4444::1", local, 50000, 22, 0x02), false},
+		{"http from allowed prefix", testTCPPacket("300:1111:2222:3333::1", local, 50000, 80, 0x02), false},
+	} {
+		if got := c.yggdrasilFirewallAllows(tc.packet); got != tc.want {
+			t.Fatalf("%s: allowed = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Replies to connections made from this node are allowed.
+	c.yggdrasilFirewallOutbound(testTCPPacket(local, "300:4444::1", 40000, 443, 0x02))
+	if !c.yggdrasilFirewallAllows(testTCPPacket("300:4444::1", local, 443, 40000, 0x12)) {
+		t.Fatal("expected the reply to be allowed")
+	}
+	if c.yggdrasilFirewallAllows(testTCPPacket("300:4444::1", local, 443, 40001, 0x12)) {
+		t.Fatal("expected traffic to another port to be denied")
+	}
+}
+
+func TestLearnedRoutes(t *testing.T) {
+	c := &cryptokey{log: log.New(io.Discard, "", 0)}
+	_ = c.configure(&config.TunnelRoutingConfig{
+		RemoteSubnets:      map[string][]string{testKey(0): {"10.0.0.0/8"}},
+		LocalSubnets:       []string{"192.168.0.0/16"},
+		AdvertisementPeers: []string{testKey(1)},
+	})
+	peer, _ := hex.DecodeString(testKey(1))
+	stranger, _ := hex.DecodeString(testKey(2))
+
+	advertised := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	msgs := encodeAdvertisement(advertised)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %d", len(msgs))
+	}
+	decoded, ok := decodeAdvertisement(msgs[0])
+	if !ok || len(decoded) != len(advertised) {
+		t.Fatalf("decodeAdvertisement = %v, %v", decoded, ok)
+	}
+	for i := range advertised {
+		if decoded[i] != advertised[i] {
+			t.Fatalf("decoded %s, want %s", decoded[i], advertised[i])
+		}
+	}
+	if _, ok := decodeAdvertisement(msgs[0][:len(msgs[0])-1]); ok {
+		t.Fatal("expected a truncated advertisement to be rejected")
+	}
+
+	now := time.Now()
+	if added := c.learnRoutes(stranger, decoded, now.Add(time.Minute)); len(added) != 0 {
+		t.Fatalf("learned %v from a key that isn't an advertisement peer", added)
+	}
+	added := c.learnRoutes(peer, decoded, now.Add(time.Minute))
+	if len(added) != 2 || added[0] != "172.16.0.0/12" || added[1] != "2001:db8::/32" {
+		t.Fatalf("learnRoutes = %v", added)
+	}
+
+	// The configured route takes precedence over the learned one.
+	if key, _ := c.getPublicKeyForAddress(netip.MustParseAddr("10.1.1.1")); hex.EncodeToString(key) != testKey(0) {
+		t.Fatal("expected the configured route to be used")
+	}
+	if key, _ := c.getPublicKeyForAddress(netip.MustParseAddr("172.16.1.1")); !bytes.Equal(key, peer) {
+		t.Fatal("expected the learned route to be used")
+	}
+
+	// A configured route replaces a learned one for the same subnet.
+	if _, err := c.addRemoteSubnet("2001:db8::/32", "", testKey(3), 0, 1); err != nil {
+		t.Fatalf("addRemoteSubnet: %v", err)
+	}
+	if key, _ := c.getPublicKeyForAddress(netip.MustParseAddr("2001:db8::1")); hex.EncodeToString(key) != testKey(3) {
+		t.Fatal("expected the added route to replace the learned one")
+	}
+
+	// Refreshing keeps the route alive, otherwise it expires.
+	c.learnRoutes(peer, decoded, now.Add(2*time.Minute))
+	if removed := c.expireLearnedRoutes(now.Add(time.Minute)); len(removed) != 0 {
+		t.Fatalf("expireLearnedRoutes removed %v before they expired", removed)
+	}
+	if removed := c.expireLearnedRoutes(now.Add(2 * time.Minute)); len(removed) != 1 || removed[0] != "172.16.0.0/12" {
+		t.Fatalf("expireLearnedRoutes = %v", removed)
+	}
+	if _, err := c.getPublicKeyForAddress(netip.MustParseAddr("172.16.1.1")); err == nil {
+		t.Fatal("expected the expired route to be removed")
+	}
+}
+
+func TestAdvertisementPrefixes(t *testing.T) {
+	c := &cryptokey{log: log.New(io.Discard, "", 0)}
+	cfg := &config.TunnelRoutingConfig{
+		AdvertisementPeers:    []string{testKey(1), testKey(2)},
+		AdvertisementPrefixes: map[string][]string{testKey(2): {"10.0.0.0/8", "::/0"}},
+	}
+	_ = c.configure(cfg)
+	now := time.Now()
+	for _, test := range []struct {
+		key        ed25519.PublicKey
+		advertised []string
+		want       []string
+	}{
+		{testPublicKey(1), []string{"0.0.0.0/0", "::/0", "172.16.0.0/12"}, []string{"172.16.0.0/12"}},
+		{testPublicKey(1), []string{"0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1", "fd00::/16"}, []string{"fd00::/16"}},
+		{testPublicKey(2), []string{"10.1.0.0/16", "0.0.0.0/0", "192.168.0.0/16", "::/0"}, []string{"10.1.0.0/16", "::/0"}},
+	} {
+		var prefixes []netip.Prefix
+		for _, cidr := range test.advertised {
+			prefixes = append(prefixes, netip.MustParsePrefix(cidr))
+		}
+		if added := c.learnRoutes(test.key, prefixes, now.Add(time.Minute)); !slices.Equal(added, test.want) {
+			t.Fatalf("learnRoutes(%s) = %v, want %v", test.advertised, added, test.want)
+		}
+	}
+
+	// Routes that are no longer allowed are removed, leaving the trie for the
+	// other address family alone.
+	next := *cfg
+	next.AdvertisementPrefixes = map[string][]string{testKey(2): {"10.0.0.0/8"}}
+	c.reconfigure(&next)
+	root := c.v4Trie.root
+	if removed := c.expireLearnedRoutes(now); !slices.Equal(removed, []string{"::/0"}) {
+		t.Fatalf("expireLearnedRoutes = %v", removed)
+	}
+	if c.v4Trie.root != root {
+		t.Fatal("expected the IPv4 trie to be left alone")
+	}
+	if _, err := c.getPublicKeyForAddress(netip.MustParseAddr("2001:db8::1")); err == nil {
+		t.Fatal("expected the default route to be removed")
+	}
+	for addr, want := range map[string]int{"10.1.1.1": 2, "172.16.1.1": 1} {
+		if key, _ := c.getPublicKeyForAddress(netip.MustParseAddr(addr)); !bytes.Equal(key, testPublicKey(want)) {
+			t.Fatalf("expected %s to be routed to key %d", addr, want)
+		}
+	}
+}
+
+func TestNodeInfoSubnets(t *testing.T) {
+	cfg := &config.TunnelRoutingConfig{
+		LocalSubnets: []string{"10.0.0.0/8", "2001:db8::/32"},
+	}
+	nodeinfo := map[string]interface{}{"name": "test"}
+	info := NodeInfo(nodeinfo, cfg)
+	if _, ok := nodeinfo[nodeInfoSection]; ok {
+		t.Fatal("expected the original NodeInfo to be left alone")
+	}
+	bs, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	subnets := nodeInfoSubnets(bs)
+	if len(subnets) != 2 || subnets[0] != "10.0.0.0/8" || subnets[1] != "2001:db8::/32" {
+		t.Fatalf("nodeInfoSubnets = %v", subnets)
+	}
+	if subnets := nodeInfoSubnets(json.RawMessage(`{"name":"test"}`)); len(subnets) != 0 {
+		t.Fatalf("expected no subnets without a ckr section, got %v", subnets)
+	}
+}
+
+func TestGetRemoteNodeInfoSubnets(t *testing.T) {
+	rwc := testReadWriteCloser()
+	if _, err := rwc.GetRemoteNodeInfoSubnets(testKey(1)); err == nil {
+		t.Fatal("expected an error without the core's getNodeInfo handler")
+	}
+
+	// The response is matched by the key that it is for, whatever its case.
+	var requested string
+	rwc.getNodeInfo = func(in json.RawMessage) (interface{}, error) {
+		var req struct{ Key string }
+		if err := json.Unmarshal(in, &req); err != nil {
+			return nil, err
+		}
+		requested = req.Key
+		return map[string]interface{}{
+			strings.ToUpper(testKey(1)): map[string]interface{}{
+				nodeInfoSection: nodeInfoCKR{Subnets: []string{"10.0.0.0/8", "nonsense", "2001:db8::/32"}},
+			},
+		}, nil
+	}
+	subnets, err := rwc.GetRemoteNodeInfoSubnets(strings.ToUpper(testKey(1)))
+	if err != nil {
+		t.Fatalf("GetRemoteNodeInfoSubnets: %v", err)
+	}
+	if requested != testKey(1) {
+		t.Fatalf("requested NodeInfo for %s", requested)
+	}
+	if !slices.Equal(subnets, []string{"10.0.0.0/8", "2001:db8::/32"}) {
+		t.Fatalf("GetRemoteNodeInfoSubnets = %v", subnets)
+	}
+	if _, err := rwc.GetRemoteNodeInfoSubnets(testKey(2)); err == nil {
+		t.Fatal("expected an error without a response for the key")
+	}
+	if _, err := rwc.GetRemoteNodeInfoSubnets("nonsense"); err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+}
+
+func BenchmarkGetPublicKeyForAddress(b *testing.B) {
+	for _, family := range []string{"IPv4", "IPv6"} {
+		for _, n := range []int{10, 1000, 100000} {
+			b.Run(fmt.Sprintf("%s/%d", family, n), func(b *testing.B) {
+				rng := rand.New(rand.NewSource(1))
+				c, prefixes := buildTestCryptokey(rng, n, family == "IPv4")
+				addrs := make([]netip.Addr, 1024)
+				for i := range addrs {
+					addrs[i] = randomAddrIn(rng, prefixes[rng.Intn(len(prefixes))])
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := c.getPublicKeyForAddress(addrs[i%len(addrs)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Measures route lookups from many goroutines at once, which should scale
+// with the number of CPUs as they don't take any locks.
+func BenchmarkGetPublicKeyForAddressParallel(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	c, prefixes := buildTestCryptokey(rng, 1000, true)
+	addrs := make([]netip.Addr, 1024)
+	for i := range addrs {
+		addrs[i] = randomAddrIn(rng, prefixes[rng.Intn(len(prefixes))])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := c.getPublicKeyForAddress(addrs[i%len(addrs)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
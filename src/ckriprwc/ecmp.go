@@ -0,0 +1,88 @@
+package ckriprwc
+
+import (
+	"crypto/ed25519"
+	"math"
+)
+
+// Traffic for a route with several destinations of the same priority is
+// spread across them by hashing each packet's flow, so that all packets of a
+// single flow are sent to the same destination. Destinations are chosen by
+// weighted rendezvous hashing, which means that when a destination becomes
+// unreachable only the flows that were using it are moved elsewhere.
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+func fnvAdd(h uint64, bs []byte) uint64 {
+	for _, b := range bs {
+		h ^= uint64(b)
+		h *= fnvPrime64
+	}
+	return h
+}
+
+// Finalises a hash so that every output bit depends on every input bit.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func keyHash(key ed25519.PublicKey) uint64 {
+	return mix64(fnvAdd(fnvOffset64, key))
+}
+
+// Returns whether packets of the given protocol start with 16-bit source and
+// destination ports.
+func hasPorts(proto byte) bool {
+	switch proto {
+	case 6, 17, 132, 136: // TCP, UDP, SCTP, UDP-Lite
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns a hash of the packet's flow. For IPv4 this is the 5-tuple, or the
+// addresses and protocol for fragments. For IPv6 this is the addresses and
+// the flow label, or the 5-tuple if no flow label has been set.
+func flowHash(bs []byte) uint64 {
+	h := uint64(fnvOffset64)
+	switch {
+	case len(bs) >= 20 && bs[0]&0xf0 == 0x40:
+		ihl := int(bs[0]&0x0f) * 4
+		proto := bs[9]
+		h = fnvAdd(h, bs[12:20])
+		h = fnvAdd(h, bs[9:10])
+		fragmented := bs[6]&0x20 != 0 || (bs[6]&0x1f != 0 || bs[7] != 0)
+		if !fragmented && hasPorts(proto) && len(bs) >= ihl+4 {
+			h = fnvAdd(h, bs[ihl:ihl+4])
+		}
+
+	case len(bs) >= 40 && bs[0]&0xf0 == 0x60:
+		h = fnvAdd(h, bs[8:40])
+		if bs[1]&0x0f != 0 || bs[2] != 0 || bs[3] != 0 {
+			h = fnvAdd(h, []byte{bs[1] & 0x0f, bs[2], bs[3]})
+		} else {
+			h = fnvAdd(h, bs[6:7])
+			if hasPorts(bs[6]) && len(bs) >= 44 {
+				h = fnvAdd(h, bs[40:44])
+			}
+		}
+	}
+	return mix64(h)
+}
+
+// Returns the rendezvous score of the destination for the given flow. The
+// destination with the highest score is chosen, and a destination with twice
+// the weight of another will be chosen for twice as many flows.
+func (d *destination) score(flow uint64) float64 {
+	u := (float64(mix64(flow^d.hash)>>11) + 0.5) / (1 << 53)
+	return -float64(d.weight) / math.Log(u)
+}
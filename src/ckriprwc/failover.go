@@ -0,0 +1,56 @@
+package ckriprwc
+
+import (
+	"crypto/ed25519"
+	"sync/atomic"
+	"time"
+)
+
+// If traffic has been sent to a destination and nothing has come back from
+// it within this time then it is considered to be unreachable, and routes
+// with other destinations will fail over to them.
+const failoverTimeout = 10 * time.Second
+
+// How often to send lookups for unreachable destinations, so that we notice
+// when they recover and can move traffic back to them.
+const failoverRecoveryInterval = 5 * time.Second
+
+// The keyState tracks whether a destination key appears to be reachable. It
+// is shared by all routes that use the same key and is updated on the packet
+// path, so it only uses atomics.
+type keyState struct {
+	key        ed25519.PublicKey
+	unanswered atomic.Int64 // Unix nanoseconds of the oldest unanswered send, or 0
+	down       atomic.Bool
+	probe      probeState
+}
+
+// Records that traffic has been sent to the destination.
+func (s *keyState) sent(now time.Time) {
+	if s.unanswered.Load() == 0 {
+		s.unanswered.CompareAndSwap(0, now.UnixNano())
+	}
+}
+
+// Records that the destination is reachable, either because traffic has been
+// received from it or because a path to it was found. Returns true if it was
+// previously considered unreachable.
+func (s *keyState) reachable() bool {
+	if s.unanswered.Load() != 0 {
+		s.unanswered.Store(0)
+	}
+	return s.down.CompareAndSwap(true, false)
+}
+
+// Returns whether the destination is considered to be unreachable, and true
+// for changed if this check is what marked it as such.
+func (s *keyState) isDown(now time.Time) (down bool, changed bool) {
+	if s.down.Load() {
+		return true, false
+	}
+	since := s.unanswered.Load()
+	if since == 0 || now.UnixNano()-since < int64(failoverTimeout) {
+		return false, false
+	}
+	return true, s.down.CompareAndSwap(false, true)
+}
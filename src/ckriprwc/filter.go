@@ -0,0 +1,274 @@
+package ckriprwc
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/neilalexander/yggdrasilckr/src/config"
+)
+
+// Routes can have a list of rules that restrict which traffic may use them.
+// Rules are checked in order and the first one that matches the packet
+// decides whether it is allowed. If no rule matches then the packet is
+// denied, unless none of the route's rules apply in the packet's direction.
+// Inbound traffic is traffic received from the route's remote nodes, and
+// outbound traffic is traffic sent to them.
+
+var errPacketDenied = errors.New("packet denied by route rules")
+
+type ruleDirection int
+
+const (
+	ruleBoth ruleDirection = iota
+	ruleInbound
+	ruleOutbound
+)
+
+type portRange struct {
+	from, to int
+}
+
+type rule struct {
+	allow       bool
+	direction   ruleDirection
+	protocol    int          // -1 for any protocol
+	local       netip.Prefix // Zero for any local address
+	localPorts  []portRange
+	remotePorts []portRange
+	icmpTypes   []int
+}
+
+// The parts of a packet that rules can match on. Ports and ICMP types are -1
+// if the packet doesn't have them, and are not known at all for fragments
+// other than the first.
+type packetFields struct {
+	src, dst         netip.Addr
+	protocol         int
+	transport        int // Offset of the transport header
+	srcPort, dstPort int
+	icmpType         int
+	fragment         bool
+}
+
+// Parses a rule from the configuration for a route of the given address
+// family.
+func parseRule(cfg config.RuleConfig, is6 bool) (rule, error) {
+	r := rule{protocol: -1}
+	switch strings.ToLower(cfg.Action) {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return rule{}, fmt.Errorf("unknown action %q", cfg.Action)
+	}
+	switch strings.ToLower(cfg.Direction) {
+	case "", "both":
+		r.direction = ruleBoth
+	case "in":
+		r.direction = ruleInbound
+	case "out":
+		r.direction = ruleOutbound
+	default:
+		return rule{}, fmt.Errorf("unknown direction %q", cfg.Direction)
+	}
+	switch protocol := strings.ToLower(cfg.Protocol); protocol {
+	case "":
+	case "tcp":
+		r.protocol = 6
+	case "udp":
+		r.protocol = 17
+	case "sctp":
+		r.protocol = 132
+	case "icmp":
+		r.protocol = 1
+		if is6 {
+			r.protocol = 58
+		}
+	case "icmpv6":
+		r.protocol = 58
+	default:
+		n, err := strconv.ParseUint(protocol, 10, 8)
+		if err != nil {
+			return rule{}, fmt.Errorf("unknown protocol %q", cfg.Protocol)
+		}
+		r.protocol = int(n)
+	}
+	if cfg.LocalSubnet != "" {
+		prefix, err := netip.ParsePrefix(cfg.LocalSubnet)
+		if err != nil {
+			return rule{}, fmt.Errorf("local subnet: %w", err)
+		}
+		if prefix.Addr().Is6() != is6 {
+			return rule{}, fmt.Errorf("local subnet %s is not the same address family", cfg.LocalSubnet)
+		}
+		r.local = prefix.Masked()
+	}
+	var err error
+	if r.localPorts, err = parsePortRanges(cfg.LocalPorts); err != nil {
+		return rule{}, fmt.Errorf("local ports: %w", err)
+	}
+	if r.remotePorts, err = parsePortRanges(cfg.RemotePorts); err != nil {
+		return rule{}, fmt.Errorf("remote ports: %w", err)
+	}
+	if (len(r.localPorts) > 0 || len(r.remotePorts) > 0) && r.protocol != -1 && !hasPorts(byte(r.protocol)) {
+		return rule{}, fmt.Errorf("protocol %q doesn't have ports", cfg.Protocol)
+	}
+	for _, t := range cfg.ICMPTypes {
+		if t < 0 || t > 255 {
+			return rule{}, fmt.Errorf("invalid ICMP type %d", t)
+		}
+	}
+	r.icmpTypes = slices.Clone(cfg.ICMPTypes)
+	return r, nil
+}
+
+// Parses ports and port ranges such as "443" or "8000-8080".
+func parsePortRanges(ports []string) ([]portRange, error) {
+	ranges := make([]portRange, 0, len(ports))
+	for _, port := range ports {
+		from, to, isRange := strings.Cut(port, "-")
+		start, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.ParseUint(to, 10, 16); err != nil || end < start {
+				return nil, fmt.Errorf("invalid port range %q", port)
+			}
+		}
+		ranges = append(ranges, portRange{from: int(start), to: int(end)})
+	}
+	return ranges, nil
+}
+
+func matchPorts(ranges []portRange, port int) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the rule applies to packets in the given direction.
+func (r *rule) appliesTo(inbound bool) bool {
+	switch r.direction {
+	case ruleInbound:
+		return inbound
+	case ruleOutbound:
+		return !inbound
+	default:
+		return true
+	}
+}
+
+// Returns whether the rule matches the packet, which is travelling in the
+// given direction.
+func (r *rule) matches(f *packetFields, inbound bool) bool {
+	if !r.appliesTo(inbound) {
+		return false
+	}
+	if r.protocol != -1 && f.protocol != r.protocol {
+		return false
+	}
+	local, localPort, remotePort := f.src, f.srcPort, f.dstPort
+	if inbound {
+		local, localPort, remotePort = f.dst, f.dstPort, f.srcPort
+	}
+	if r.local.IsValid() && !r.local.Contains(local) {
+		return false
+	}
+	if f.fragment {
+		// Later fragments don't have the transport header, so they can
+		// only be matched on their addresses and protocol.
+		return true
+	}
+	if !matchPorts(r.localPorts, localPort) || !matchPorts(r.remotePorts, remotePort) {
+		return false
+	}
+	if len(r.icmpTypes) > 0 && !slices.Contains(r.icmpTypes, f.icmpType) {
+		return false
+	}
+	return true
+}
+
+// Returns whether the route's rules allow the packet, which is travelling in
+// the given direction.
+func (rt *route) allows(f *packetFields, inbound bool) bool {
+	applies := false
+	for i := range rt.rules {
+		r := &rt.rules[i]
+		if r.matches(f, inbound) {
+			return r.allow
+		}
+		applies = applies || r.appliesTo(inbound)
+	}
+	return !applies
+}
+
+// Parses the parts of an IPv4 or IPv6 packet that rules can match on. For
+// IPv6, extension headers are skipped to find the transport header.
+func parsePacketFields(bs []byte) (packetFields, bool) {
+	f := packetFields{srcPort: -1, dstPort: -1, icmpType: -1}
+	var off int
+	switch {
+	case len(bs) >= 20 && bs[0]&0xf0 == 0x40:
+		f.src = netip.AddrFrom4([4]byte(bs[12:16]))
+		f.dst = netip.AddrFrom4([4]byte(bs[16:20]))
+		f.protocol = int(bs[9])
+		f.fragment = bs[6]&0x1f != 0 || bs[7] != 0
+		off = int(bs[0]&0x0f) * 4
+
+	case len(bs) >= 40 && bs[0]&0xf0 == 0x60:
+		f.src = netip.AddrFrom16([16]byte(bs[8:24]))
+		f.dst = netip.AddrFrom16([16]byte(bs[24:40]))
+		next, off6 := bs[6], 40
+	headers:
+		for {
+			switch next {
+			case 0, 43, 60: // Hop-by-hop, routing, destination options
+				if len(bs) < off6+2 {
+					return f, false
+				}
+				next, off6 = bs[off6], off6+(int(bs[off6+1])+1)*8
+			case 44: // Fragment
+				if len(bs) < off6+8 {
+					return f, false
+				}
+				f.fragment = f.fragment || bs[off6+2] != 0 || bs[off6+3]&0xf8 != 0
+				next, off6 = bs[off6], off6+8
+			case 51: // Authentication header
+				if len(bs) < off6+2 {
+					return f, false
+				}
+				next, off6 = bs[off6], off6+(int(bs[off6+1])+2)*4
+			default:
+				break headers
+			}
+		}
+		f.protocol, off = int(next), off6
+
+	default:
+		return f, false
+	}
+	f.transport = off
+	if f.fragment {
+		return f, true
+	}
+	switch {
+	case hasPorts(byte(f.protocol)) && len(bs) >= off+4:
+		f.srcPort = int(bs[off])<<8 | int(bs[off+1])
+		f.dstPort = int(bs[off+2])<<8 | int(bs[off+3])
+	case (f.protocol == 1 || f.protocol == 58) && len(bs) >= off+8:
+		f.icmpType = int(bs[off])
+	}
+	return f, true
+}
@@ -0,0 +1,115 @@
+package ckriprwc
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/neilalexander/yggdrasilckr/src/config"
+)
+
+// The Yggdrasil firewall applies to native Yggdrasil traffic that is sent to
+// this node by other nodes. When it is enabled, packets are only accepted if
+// they belong to a flow that was started from this side, or if they are
+// allowed by one of the rules. Everything else is denied.
+
+type yggdrasilFirewall struct {
+	enabled bool
+	rules   []yggdrasilRule
+}
+
+type yggdrasilRule struct {
+	rule
+	sources []netip.Prefix // Empty for any source
+}
+
+// Parses the firewall from the configuration, along with errors for any rules
+// that are not valid.
+func parseYggdrasilFirewall(cfg config.YggdrasilFirewallConfig) (*yggdrasilFirewall, []error) {
+	fw := &yggdrasilFirewall{enabled: cfg.Enabled}
+	var errs []error
+	for i, rc := range cfg.Rules {
+		action := rc.Action
+		if action == "" {
+			action = "allow"
+		}
+		parsed, err := parseRule(config.RuleConfig{
+			Action:      action,
+			Direction:   "in",
+			Protocol:    rc.Protocol,
+			LocalPorts:  rc.LocalPorts,
+			RemotePorts: rc.RemotePorts,
+			ICMPTypes:   rc.ICMPTypes,
+		}, true)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i+1, err))
+			continue
+		}
+		sources, serrs := parseYggdrasilAllowed(rc.Sources)
+		for _, err := range serrs {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i+1, err))
+		}
+		if len(serrs) > 0 && len(sources) == 0 {
+			// Don't let a rule with only invalid sources match everything.
+			continue
+		}
+		fw.rules = append(fw.rules, yggdrasilRule{rule: parsed, sources: sources})
+	}
+	return fw, errs
+}
+
+func (r *yggdrasilRule) matchesSource(addr netip.Addr) bool {
+	if len(r.sources) == 0 {
+		return true
+	}
+	for _, prefix := range r.sources {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the Yggdrasil firewall from the configuration.
+func (c *cryptokey) setYggdrasilFirewall(config *config.TunnelRoutingConfig) {
+	fw, errs := parseYggdrasilFirewall(config.YggdrasilFirewall)
+	for _, err := range errs {
+		c.log.Warnf("Error in YggdrasilFirewall: %s", err)
+	}
+	c.yggdrasilFirewall.Store(fw)
+}
+
+// Returns whether the firewall allows an inbound native Yggdrasil packet.
+// Packets that belong to flows started from this side are always allowed.
+func (c *cryptokey) yggdrasilFirewallAllows(packet []byte) bool {
+	fw := c.yggdrasilFirewall.Load()
+	if fw == nil || !fw.enabled {
+		return true
+	}
+	f, ok := parsePacketFields(packet)
+	if !ok {
+		return false
+	}
+	if c.conntrack.inbound(&f, packet, time.Now()) {
+		return true
+	}
+	for i := range fw.rules {
+		r := &fw.rules[i]
+		if r.matchesSource(f.src) && r.matches(&f, true) {
+			return r.allow
+		}
+	}
+	return false
+}
+
+// Records an outbound native Yggdrasil packet, so that replies to it are
+// allowed by the firewall.
+func (c *cryptokey) yggdrasilFirewallOutbound(packet []byte) {
+	fw := c.yggdrasilFirewall.Load()
+	if fw == nil || !fw.enabled {
+		return
+	}
+	if f, ok := parsePacketFields(packet); ok {
+		c.conntrack.outbound(&f, packet, time.Now())
+	}
+}
@@ -0,0 +1,288 @@
+package ckriprwc
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+	"time"
+
+	"github.com/neilalexander/yggdrasilckr/src/config"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+// The key store caches the keys of remote nodes that native Yggdrasil traffic
+// is exchanged with, and buffers packets to nodes whose keys are still being
+// looked up. Both are bounded, and when either is full the entries that were
+// least recently used are evicted to make room for new ones. Entries that have
+// been idle for longer than their TTL are removed by a sweeper, rather than
+// by a timer for each entry, so that using an entry is cheap.
+//
+// Packets to and from nodes whose keys are known are the common case, so the
+// keys are kept in sharded maps that can be read without taking the mutex,
+// and their use is recorded with an atomic timestamp rather than by moving
+// them in a list. Changes to the keys are rare and are serialized by the
+// mutex, as is everything to do with the buffers.
+//
+// So that the sweeper only visits keys that may have expired, the keys are
+// also kept in a heap ordered by when each is due to be checked, which is the
+// key TTL after it was last seen when it was last checked. A key that has
+// been seen since is due again a TTL after that, and is put back.
+
+const (
+	keyStoreDefaultKeyTTL     = 2 * time.Minute
+	keyStoreDefaultPendingTTL = 2 * time.Minute
+	keyStoreDefaultMaxKeys    = 65536
+	keyStoreDefaultMaxPending = 4096
+)
+
+// How often the sweeper removes expired keys and buffers.
+const keyStoreSweepInterval = time.Second
+
+// How precisely the last use of each key is recorded.
+const keySeenResolution = 100 * time.Millisecond
+
+// Sets the TTLs and limits of the key store from the configuration, using the
+// defaults for any that aren't set. Entries beyond the new limits are evicted
+// straight away, while the new TTLs apply from the next sweep.
+func (k *keyStore) setLimits(cfg *config.TunnelRoutingConfig) {
+	var ks config.KeyStoreConfig
+	if cfg != nil {
+		ks = cfg.KeyStore
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	ttl := k.keyTTL
+	k.keyTTL = time.Duration(ks.KeyTTL) * time.Second
+	if k.keyTTL == 0 {
+		k.keyTTL = keyStoreDefaultKeyTTL
+	}
+	k.pendingTTL = time.Duration(ks.PendingTTL) * time.Second
+	if k.pendingTTL == 0 {
+		k.pendingTTL = keyStoreDefaultPendingTTL
+	}
+	if k.maxKeys = int(ks.MaxKeys); k.maxKeys == 0 {
+		k.maxKeys = keyStoreDefaultMaxKeys
+	}
+	if k.maxPending = int(ks.MaxPending); k.maxPending == 0 {
+		k.maxPending = keyStoreDefaultMaxPending
+	}
+	if k.keyTTL != ttl {
+		for _, info := range k.expiries {
+			info.due = info.lastSeen.Load() + int64(k.keyTTL)
+		}
+		heap.Init(&k.expiries)
+	}
+	k._evictKeys(k.maxKeys)
+	for len(k.addrBuffer)+len(k.subnetBuffer) > k.maxPending && k.buffersTail != nil {
+		k.dropped.Add(uint64(len(k._removeBuffer(k.buffersTail))))
+	}
+}
+
+// Adds the key to the store. If the store is full then the least recently
+// used sixteenth of the keys is evicted, so that adding each key doesn't have
+// to search all of them. Mutex must be held.
+func (k *keyStore) _addKey(info *keyInfo) {
+	if k.keyToInfo.len() >= k.maxKeys {
+		k._evictKeys(k.maxKeys - 1 - k.maxKeys/16)
+	}
+	k.keyToInfo.set(info.key, info)
+	k.addrToInfo.set(info.address, info)
+	k.subnetToInfo.set(info.subnet, info)
+	info.due = info.lastSeen.Load() + int64(k.keyTTL)
+	heap.Push(&k.expiries, info)
+}
+
+// Removes the keys from the maps, other than any addresses or subnets that now
+// belong to other keys, and from the expiry heap if they haven't already been
+// popped from it. Mutex must be held.
+func (k *keyStore) _removeKeys(infos []*keyInfo) {
+	if len(infos) == 0 {
+		return
+	}
+	keys := make([]keyArray, 0, len(infos))
+	addrs := make([]address.Address, 0, len(infos))
+	subnets := make([]address.Subnet, 0, len(infos))
+	remove := make(map[*keyInfo]struct{}, len(infos))
+	for _, info := range infos {
+		keys = append(keys, info.key)
+		addrs = append(addrs, info.address)
+		subnets = append(subnets, info.subnet)
+		remove[info] = struct{}{}
+		if info.index >= 0 {
+			heap.Remove(&k.expiries, info.index)
+		}
+	}
+	removed := func(info *keyInfo) bool {
+		_, ok := remove[info]
+		return ok
+	}
+	k.keyToInfo.deleteKeys(keys, func(_ keyArray, info *keyInfo) bool { return removed(info) })
+	k.addrToInfo.deleteKeys(addrs, func(_ address.Address, info *keyInfo) bool { return removed(info) })
+	k.subnetToInfo.deleteKeys(subnets, func(_ address.Subnet, info *keyInfo) bool { return removed(info) })
+}
+
+// A min-heap of keys by when they are due to be checked for expiry.
+type keyExpiries []*keyInfo
+
+func (h keyExpiries) Len() int           { return len(h) }
+func (h keyExpiries) Less(i, j int) bool { return h[i].due < h[j].due }
+
+func (h keyExpiries) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *keyExpiries) Push(x any) {
+	info := x.(*keyInfo)
+	info.index = len(*h)
+	*h = append(*h, info)
+}
+
+func (h *keyExpiries) Pop() any {
+	old := *h
+	info := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	info.index = -1
+	return info
+}
+
+// Evicts the least recently used keys until no more than n remain. Mutex must
+// be held.
+func (k *keyStore) _evictKeys(n int) {
+	count := k.keyToInfo.len()
+	if count <= n {
+		return
+	}
+	// Keys last seen at the same time are ordered arbitrarily, so that exactly
+	// enough are evicted even if many of them were seen together.
+	type seenKey struct {
+		info *keyInfo
+		seen int64
+	}
+	keys := make([]seenKey, 0, count)
+	for _, info := range k.keyToInfo.all() {
+		keys = append(keys, seenKey{info, info.lastSeen.Load()})
+	}
+	slices.SortFunc(keys, func(a, b seenKey) int {
+		return cmp.Compare(a.seen, b.seen)
+	})
+	evict := make([]*keyInfo, 0, len(keys)-max(n, 0))
+	for _, key := range keys[:len(keys)-max(n, 0)] {
+		evict = append(evict, key.info)
+	}
+	k._removeKeys(evict)
+}
+
+// Starts buffering packets for the destination of the buffer, evicting the
+// least recently used buffers if there are too many. Mutex must be held.
+func (k *keyStore) _addBuffer(buf *buffer) {
+	for len(k.addrBuffer)+len(k.subnetBuffer) >= k.maxPending && k.buffersTail != nil {
+		k.dropped.Add(uint64(len(k._removeBuffer(k.buffersTail))))
+	}
+	if buf.subnet != (address.Subnet{}) {
+		k.subnetBuffer[buf.subnet] = buf
+	} else {
+		k.addrBuffer[buf.address] = buf
+	}
+	k._pushBuffer(buf)
+	buf.created = time.Now()
+}
+
+// Removes the buffer, if it is still there, and returns its packets. Mutex
+// must be held.
+func (k *keyStore) _removeBuffer(buf *buffer) [][]byte {
+	if buf.subnet != (address.Subnet{}) {
+		if k.subnetBuffer[buf.subnet] != buf {
+			return nil
+		}
+		delete(k.subnetBuffer, buf.subnet)
+	} else {
+		if k.addrBuffer[buf.address] != buf {
+			return nil
+		}
+		delete(k.addrBuffer, buf.address)
+	}
+	k._unlinkBuffer(buf)
+	return k._dequeue(buf)
+}
+
+// Marks the buffer as the most recently used. Mutex must be held.
+func (k *keyStore) _touchBuffer(buf *buffer) {
+	if k.buffersHead != buf {
+		k._unlinkBuffer(buf)
+		k._pushBuffer(buf)
+	}
+}
+
+func (k *keyStore) _pushBuffer(buf *buffer) {
+	buf.prev, buf.next = nil, k.buffersHead
+	if k.buffersHead != nil {
+		k.buffersHead.prev = buf
+	}
+	k.buffersHead = buf
+	if k.buffersTail == nil {
+		k.buffersTail = buf
+	}
+}
+
+func (k *keyStore) _unlinkBuffer(buf *buffer) {
+	if buf.prev != nil {
+		buf.prev.next = buf.next
+	} else {
+		k.buffersHead = buf.next
+	}
+	if buf.next != nil {
+		buf.next.prev = buf.prev
+	} else {
+		k.buffersTail = buf.prev
+	}
+	buf.prev, buf.next = nil, nil
+}
+
+// Removes keys that haven't been used within the key TTL and buffers whose key
+// lookups haven't completed within the pending TTL, answering the buffered
+// packets with ICMP no route messages.
+func (k *keyStore) sweep(now time.Time) {
+	var packets [][]byte
+	k.mutex.Lock()
+	var expired []*keyInfo
+	for len(k.expiries) > 0 && k.expiries[0].due <= now.UnixNano() {
+		info := k.expiries[0]
+		if due := info.lastSeen.Load() + int64(k.keyTTL); due > now.UnixNano() {
+			// Seen since it was last checked.
+			info.due = due
+			heap.Fix(&k.expiries, 0)
+			continue
+		}
+		heap.Pop(&k.expiries)
+		expired = append(expired, info)
+	}
+	k._removeKeys(expired)
+	pendingCutoff := now.Add(-k.pendingTTL)
+	for buf := k.buffersHead; buf != nil; {
+		next := buf.next
+		if !buf.created.After(pendingCutoff) {
+			packets = append(packets, k._removeBuffer(buf)...)
+		}
+		buf = next
+	}
+	k.mutex.Unlock()
+	for _, packet := range packets {
+		k.sendNoRoute(packet)
+	}
+}
+
+func (k *keyStore) keyStoreSweeper() {
+	ticker := time.NewTicker(keyStoreSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			k.sweep(time.Now())
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package ckriprwc
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When masquerading is enabled, traffic arriving from remote nodes has its
+// source rewritten to one of this node's Addresses before it is handed to the
+// TUN adapter, so that the node can be used as an exit without kernel NAT.
+// Replies to the masquerade address are translated back in writePC before
+// they are routed. Only TCP, UDP and ICMP echo can be translated, along with
+// ICMP errors about them, and other traffic from remote nodes is dropped.
+//
+// Traffic from remote nodes that is addressed to this node itself, or that
+// belongs to a flow started from this side, is left alone so that it reaches
+// the socket that is waiting for it. Flows that are started from this side
+// are tracked for this whenever masquerading is enabled.
+
+// Maximum number of mappings. New flows are dropped while the table is full.
+const natMaxEntries = 65536
+
+// Ports below this are only used if they are the original source port.
+const natPortMin = 1024
+
+// Mappings are looked up either by the inside address and port, which are
+// the original source of traffic from the remote node, or by the masquerade
+// address and the port that was allocated for it. For ICMP echo the port is
+// the echo identifier and the remote port is zero.
+type natKey struct {
+	protocol   uint8
+	addr       netip.Addr
+	port       uint16
+	remote     netip.Addr
+	remotePort uint16
+}
+
+type natMapping struct {
+	protocol uint8
+	inside   netip.AddrPort
+	outside  netip.AddrPort
+	remote   netip.AddrPort
+	expires  time.Time
+}
+
+func (m *natMapping) insideKey() natKey {
+	return natKey{m.protocol, m.inside.Addr(), m.inside.Port(), m.remote.Addr(), m.remote.Port()}
+}
+
+func (m *natMapping) outsideKey() natKey {
+	return natKey{m.protocol, m.outside.Addr(), m.outside.Port(), m.remote.Addr(), m.remote.Port()}
+}
+
+type nat struct {
+	sync.Mutex
+	enabled atomic.Bool
+	v4, v6  netip.Addr   // Masquerade addresses, invalid if not set
+	local   []netip.Addr // All of this node's addresses
+	inside  map[natKey]*natMapping
+	outside map[natKey]*natMapping
+	flows   conntrack // Flows started from this side
+}
+
+// Sets the masquerade addresses and the addresses of this node, removing any
+// mappings that use addresses that are no longer configured. If neither
+// masquerade address is valid then traffic is not translated.
+func (t *nat) setAddresses(v4, v6 netip.Addr, local []netip.Addr) {
+	t.Lock()
+	defer t.Unlock()
+	t.v4, t.v6 = v4, v6
+	t.local = local
+	t.enabled.Store(v4.IsValid() || v6.IsValid())
+	for _, m := range t.inside {
+		if addr := m.outside.Addr(); addr != v4 && addr != v6 {
+			t._remove(m)
+		}
+	}
+}
+
+// Returns the valid addresses from the configured interface addresses.
+func interfaceAddresses(addresses []string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, a := range addresses {
+		if prefix, err := netip.ParsePrefix(a); err == nil {
+			addrs = append(addrs, prefix.Addr())
+		}
+	}
+	return addrs
+}
+
+// Returns the masquerade addresses from the interface addresses, which are
+// the first IPv4 and IPv6 address given.
+func masqueradeAddresses(addresses []netip.Addr) (v4, v6 netip.Addr) {
+	for _, addr := range addresses {
+		switch {
+		case addr.Is4() && !v4.IsValid():
+			v4 = addr
+		case addr.Is6() && !v6.IsValid():
+			v6 = addr
+		}
+	}
+	return v4, v6
+}
+
+// Returns whether the address is one of this node's own. Lock must be held.
+func (t *nat) _isLocal(addr netip.Addr) bool {
+	for _, local := range t.local {
+		if addr == local {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the key of the packet from the point of view of its sender, or
+// from the point of view of its receiver if reverse is set.
+func natKeyFor(f *packetFields, packet []byte, reverse bool) (natKey, bool) {
+	k := natKey{protocol: uint8(f.protocol), addr: f.src, remote: f.dst}
+	if reverse {
+		k.addr, k.remote = f.dst, f.src
+	}
+	switch {
+	case f.protocol == 6 || f.protocol == 17:
+		if f.srcPort < 0 {
+			return natKey{}, false
+		}
+		k.port, k.remotePort = uint16(f.srcPort), uint16(f.dstPort)
+		if reverse {
+			k.port, k.remotePort = uint16(f.dstPort), uint16(f.srcPort)
+		}
+	case isICMPEcho(f):
+		if len(packet) < f.transport+6 {
+			return natKey{}, false
+		}
+		k.port = binary.BigEndian.Uint16(packet[f.transport+4:])
+	default:
+		return natKey{}, false
+	}
+	return k, true
+}
+
+// Translates a packet from a remote node, returning false if it should be
+// dropped. Packets to this node and replies to flows started from this side
+// aren't translated.
+func (t *nat) inbound(bs []byte, now time.Time) bool {
+	if !t.enabled.Load() {
+		return true
+	}
+	t.Lock()
+	defer t.Unlock()
+	addr := t.v4
+	if bs[0]&0xf0 == 0x60 {
+		addr = t.v6
+	}
+	if !addr.IsValid() {
+		return true
+	}
+	f, ok := parsePacketFields(bs)
+	if !ok {
+		return false
+	}
+	if t._isLocal(f.dst) || t.flows.inbound(&f, bs, now) {
+		return true
+	}
+	if f.fragment {
+		return false
+	}
+	if isICMPError(&f) {
+		// The error is about a packet that was sent to the remote node
+		// through the mapping, so that packet's destination is translated.
+		inner := bs[f.transport+8:]
+		fi, ok := parsePacketFields(inner)
+		if !ok {
+			return false
+		}
+		k, ok := natKeyFor(&fi, inner, true)
+		if !ok {
+			return false
+		}
+		m := t._lookup(t.inside, k, now)
+		if m == nil {
+			return false
+		}
+		natRewriteAddr(inner, &fi, false, m.outside.Addr())
+		natRewritePort(inner, &fi, false, m.outside.Port())
+		natRewriteAddr(bs, &f, true, m.outside.Addr())
+		icmpChecksum(bs, &f)
+		return true
+	}
+	if f.protocol == 1 && f.icmpType != 8 || f.protocol == 58 && f.icmpType != 128 {
+		return false
+	}
+	k, ok := natKeyFor(&f, bs, false)
+	if !ok {
+		return false
+	}
+	m := t._lookup(t.inside, k, now)
+	if m == nil {
+		if m = t._allocate(k, addr, now); m == nil {
+			return false
+		}
+	}
+	m.update(&f, bs, now)
+	natRewriteAddr(bs, &f, true, m.outside.Addr())
+	natRewritePort(bs, &f, true, m.outside.Port())
+	return true
+}
+
+// Translates a reply that is addressed to the masquerade address back to the
+// original source, in a copy of the packet. Other packets are left as they
+// are, and are recorded as flows started from this side unless they are ICMP
+// errors.
+func (t *nat) outbound(p *outPacket, now time.Time) {
+	if !t.enabled.Load() {
+		return
+	}
+	f, ok := parsePacketFields(p.bs)
+	if !ok {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if !f.fragment && t._translateReply(p, &f, now) || isICMPError(&f) {
+		return
+	}
+	t.flows.outbound(&f, p.bs, now)
+}
+
+// Translates a reply to masqueraded traffic, returning false if the packet
+// isn't one. Lock must be held.
+func (t *nat) _translateReply(p *outPacket, f *packetFields, now time.Time) bool {
+	if f.dst != t.v4 && f.dst != t.v6 {
+		return false
+	}
+	if isICMPError(f) {
+		inner := p.bs[f.transport+8:]
+		fi, ok := parsePacketFields(inner)
+		if !ok {
+			return false
+		}
+		k, ok := natKeyFor(&fi, inner, false)
+		if !ok {
+			return false
+		}
+		m := t._lookup(t.outside, k, now)
+		if m == nil {
+			return false
+		}
+		bs := p.writable()
+		inner = bs[f.transport+8:]
+		natRewriteAddr(inner, &fi, true, m.inside.Addr())
+		natRewritePort(inner, &fi, true, m.inside.Port())
+		natRewriteAddr(bs, f, false, m.inside.Addr())
+		icmpChecksum(bs, f)
+		return true
+	}
+	if f.protocol == 1 && f.icmpType != 0 || f.protocol == 58 && f.icmpType != 129 {
+		return false
+	}
+	k, ok := natKeyFor(f, p.bs, true)
+	if !ok {
+		return false
+	}
+	m := t._lookup(t.outside, k, now)
+	if m == nil {
+		return false
+	}
+	bs := p.writable()
+	m.update(f, bs, now)
+	natRewriteAddr(bs, f, false, m.inside.Addr())
+	natRewritePort(bs, f, false, m.inside.Port())
+	return true
+}
+
+// Returns the mapping with the given key, if it has not expired. Lock must
+// be held.
+func (t *nat) _lookup(table map[natKey]*natMapping, k natKey, now time.Time) *natMapping {
+	m := table[k]
+	if m != nil && !now.Before(m.expires) {
+		t._remove(m)
+		return nil
+	}
+	return m
+}
+
+// Creates a mapping for a new flow, keeping the original port if it is free.
+// Returns nil if the table is full or there are no free ports. Lock must be
+// held.
+func (t *nat) _allocate(k natKey, addr netip.Addr, now time.Time) *natMapping {
+	if len(t.inside) >= natMaxEntries {
+		t._expire(now)
+		if len(t.inside) >= natMaxEntries {
+			return nil
+		}
+	}
+	if t.inside == nil {
+		t.inside = make(map[natKey]*natMapping)
+		t.outside = make(map[natKey]*natMapping)
+	}
+	free := func(port uint16) bool {
+		m := t._lookup(t.outside, natKey{k.protocol, addr, port, k.remote, k.remotePort}, now)
+		return m == nil
+	}
+	port, found := k.port, k.port >= natPortMin && free(k.port)
+	const count = 65536 - natPortMin
+	for i, start := 0, rand.IntN(count); !found && i < count; i++ {
+		port = uint16(natPortMin + (start+i)%count)
+		found = free(port)
+	}
+	if !found {
+		return nil
+	}
+	m := &natMapping{
+		protocol: k.protocol,
+		inside:   netip.AddrPortFrom(k.addr, k.port),
+		outside:  netip.AddrPortFrom(addr, port),
+		remote:   netip.AddrPortFrom(k.remote, k.remotePort),
+	}
+	t.inside[m.insideKey()] = m
+	t.outside[m.outsideKey()] = m
+	return m
+}
+
+// Removes a mapping. Lock must be held.
+func (t *nat) _remove(m *natMapping) {
+	delete(t.inside, m.insideKey())
+	delete(t.outside, m.outsideKey())
+}
+
+// Removes all mappings and flows that have expired.
+func (t *nat) expire(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	t._expire(now)
+	t.flows.expire(now)
+}
+
+func (t *nat) _expire(now time.Time) {
+	for _, m := range t.inside {
+		if !now.Before(m.expires) {
+			t._remove(m)
+		}
+	}
+}
+
+// Extends the lifetime of the mapping for a packet that uses it. TCP mappings
+// are kept for less time once the connection is being closed.
+func (m *natMapping) update(f *packetFields, packet []byte, now time.Time) {
+	timeout := conntrackICMPTimeout
+	switch f.protocol {
+	case 6:
+		timeout = conntrackTCPEstablishedTimeout
+		if len(packet) >= f.transport+14 && packet[f.transport+13]&0x05 != 0 { // FIN or RST
+			timeout = conntrackTCPClosingTimeout
+		}
+	case 17:
+		timeout = conntrackUDPStreamTimeout
+	}
+	m.expires = now.Add(timeout)
+}
+
+// Returns the offset of the transport checksum that covers the addresses and
+// ports of the packet, or -1 if there isn't one or it isn't present.
+func natChecksumOffset(bs []byte, f *packetFields) int {
+	if f.fragment {
+		return -1
+	}
+	off := -1
+	switch f.protocol {
+	case 6:
+		off = f.transport + 16
+	case 17:
+		off = f.transport + 6
+		if len(bs) >= off+2 && bs[off] == 0 && bs[off+1] == 0 {
+			// No checksum, which is only allowed for IPv4.
+			return -1
+		}
+	case 1, 58:
+		off = f.transport + 2
+	}
+	if len(bs) < off+2 {
+		return -1
+	}
+	return off
+}
+
+// Rewrites the source or destination address of the packet, updating the
+// checksums that cover it.
+func natRewriteAddr(bs []byte, f *packetFields, source bool, addr netip.Addr) {
+	var off int
+	switch {
+	case f.src.Is4() && source:
+		off = 12
+	case f.src.Is4():
+		off = 16
+	case source:
+		off = 8
+	default:
+		off = 24
+	}
+	to := addr.AsSlice()
+	from := bs[off : off+len(to)]
+	if f.src.Is4() {
+		checksumUpdate(bs[10:], from, to)
+	}
+	if sum := natChecksumOffset(bs, f); sum >= 0 && f.protocol != 1 {
+		checksumUpdate(bs[sum:], from, to)
+		if f.protocol == 17 && bs[sum] == 0 && bs[sum+1] == 0 {
+			bs[sum], bs[sum+1] = 0xff, 0xff
+		}
+	}
+	copy(from, to)
+}
+
+// Rewrites the source or destination port of the packet, or the identifier
+// of an ICMP echo message, updating the checksum that covers it.
+func natRewritePort(bs []byte, f *packetFields, source bool, port uint16) {
+	var off int
+	switch {
+	case f.protocol == 1 || f.protocol == 58:
+		off = f.transport + 4
+	case source:
+		off = f.transport
+	default:
+		off = f.transport + 2
+	}
+	if len(bs) < off+2 {
+		return
+	}
+	var to [2]byte
+	binary.BigEndian.PutUint16(to[:], port)
+	if sum := natChecksumOffset(bs, f); sum >= 0 {
+		checksumUpdate(bs[sum:], bs[off:off+2], to[:])
+		if f.protocol == 17 && bs[sum] == 0 && bs[sum+1] == 0 {
+			bs[sum], bs[sum+1] = 0xff, 0xff
+		}
+	}
+	copy(bs[off:], to[:])
+}
+
+// Updates the checksum at the start of sum for a change to 16-bit aligned
+// data that it covers, as described in RFC 1624.
+func checksumUpdate(sum []byte, from, to []byte) {
+	s := uint32(^binary.BigEndian.Uint16(sum))
+	for i := 0; i+1 < len(from); i += 2 {
+		s += uint32(^binary.BigEndian.Uint16(from[i:]))
+		s += uint32(binary.BigEndian.Uint16(to[i:]))
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	binary.BigEndian.PutUint16(sum, ^uint16(s))
+}
+
+// Recalculates the checksum of an ICMP or ICMPv6 message, which is needed
+// after the packet quoted in an error has been changed.
+func icmpChecksum(bs []byte, f *packetFields) {
+	msg := bs[f.transport:]
+	msg[2], msg[3] = 0, 0
+	var s uint32
+	if f.protocol == 58 {
+		for i := 8; i < 40; i += 2 {
+			s += uint32(binary.BigEndian.Uint16(bs[i:]))
+		}
+		s += uint32(len(msg)>>16) + uint32(len(msg)&0xffff) + 58
+	}
+	for i := 0; i < len(msg); i += 2 {
+		if i+1 < len(msg) {
+			s += uint32(binary.BigEndian.Uint16(msg[i:]))
+		} else {
+			s += uint32(msg[i]) << 8
+		}
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	binary.BigEndian.PutUint16(msg[2:], ^uint16(s))
+}
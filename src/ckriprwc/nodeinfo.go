@@ -0,0 +1,130 @@
+package ckriprwc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+
+	"github.com/neilalexander/yggdrasilckr/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// Nodes publish the subnets that are reachable through them in a "ckr"
+// section of their NodeInfo, so that other nodes can look them up and route
+// them without both sides having to agree on them beforehand.
+
+const nodeInfoSection = "ckr"
+
+type nodeInfoCKR struct {
+	Subnets []string `json:"subnets"`
+}
+
+// NodeInfo returns a copy of the given NodeInfo with a "ckr" section listing
+// the LocalSubnets from the configuration, which should be passed to the core
+// using core.NodeInfo. The NodeInfo is returned unchanged if there are no
+// local subnets.
+func NodeInfo(nodeinfo map[string]interface{}, config *config.TunnelRoutingConfig) map[string]interface{} {
+	if config == nil || len(config.LocalSubnets) == 0 {
+		return nodeinfo
+	}
+	info := make(map[string]interface{}, len(nodeinfo)+1)
+	maps.Copy(info, nodeinfo)
+	info[nodeInfoSection] = nodeInfoCKR{
+		Subnets: append([]string(nil), config.LocalSubnets...),
+	}
+	return info
+}
+
+// Collects the admin handlers registered by the core, so that they can be
+// called directly. The core has no other way to fetch the NodeInfo of remote
+// nodes.
+type coreHandlers map[string]core.AddHandlerFunc
+
+func (h coreHandlers) AddHandler(name, desc string, args []string, handlerfunc core.AddHandlerFunc) error {
+	h[name] = handlerfunc
+	return nil
+}
+
+// GetRemoteNodeInfoSubnets fetches the NodeInfo of the node with the given
+// public key and returns the subnets that it publishes in its "ckr" section.
+// Subnets that are not valid as remote subnets are skipped.
+func (rwc *ReadWriteCloser) GetRemoteNodeInfoSubnets(key string) ([]string, error) {
+	bpk, err := hex.DecodeString(key)
+	if err != nil || len(bpk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q", key)
+	}
+	if rwc.getNodeInfo == nil {
+		return nil, errors.New("the core doesn't support fetching NodeInfo")
+	}
+	req, err := json.Marshal(map[string]string{"key": hex.EncodeToString(bpk)})
+	if err != nil {
+		return nil, err
+	}
+	res, err := rwc.getNodeInfo(req)
+	if err != nil {
+		return nil, fmt.Errorf("getNodeInfo: %w", err)
+	}
+	bs, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	var infos map[string]json.RawMessage
+	if err := json.Unmarshal(bs, &infos); err != nil {
+		return nil, fmt.Errorf("getNodeInfo: %w", err)
+	}
+	var info json.RawMessage
+	for k, v := range infos {
+		if rk, err := hex.DecodeString(k); err == nil && bytes.Equal(rk, bpk) {
+			info = v
+			break
+		}
+	}
+	if info == nil {
+		return nil, fmt.Errorf("getNodeInfo: no response for %s", key)
+	}
+	var subnets []string
+	for _, subnet := range nodeInfoSubnets(info) {
+		if _, _, err := parseRemoteSubnet(subnet, key); err != nil {
+			rwc.ckr.log.Warnf("Ignoring subnet %q published by %s: %s", subnet, key, err)
+			continue
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// Returns the subnets listed in the "ckr" section of a NodeInfo response.
+func nodeInfoSubnets(info json.RawMessage) []string {
+	var nodeinfo struct {
+		CKR *nodeInfoCKR `json:"ckr"`
+	}
+	if err := json.Unmarshal(info, &nodeinfo); err != nil || nodeinfo.CKR == nil {
+		return nil
+	}
+	return nodeinfo.CKR.Subnets
+}
+
+// ImportRemoteSubnets fetches the subnets published in the NodeInfo of the
+// node with the given public key and returns them. If apply is true then
+// they are also added as CKR routes via that node, skipping any which are
+// already routed via it. The routes are not saved to the configuration.
+func (rwc *ReadWriteCloser) ImportRemoteSubnets(key string, apply bool) ([]string, error) {
+	subnets, err := rwc.GetRemoteNodeInfoSubnets(key)
+	if err != nil || !apply {
+		return subnets, err
+	}
+	var errs []error
+	for _, subnet := range subnets {
+		if rwc.ckr.hasRemoteSubnet(subnet, key) {
+			continue
+		}
+		if err := rwc.AddRemoteSubnet(subnet, "", key, 0, 1); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", subnet, err))
+		}
+	}
+	return subnets, errors.Join(errs...)
+}
@@ -0,0 +1,116 @@
+package ckriprwc
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	iwt "github.com/Arceliar/ironwood/types"
+)
+
+// The prober periodically sends a probe request to each distinct destination
+// key in the routing table. If enough probes in a row go unanswered then the
+// destination is considered to be unreachable, which routes with more than
+// one destination will fail over from in the same way as when traffic goes
+// unanswered.
+
+// Number of probes in a row that can go unanswered before the destination is
+// considered to be unreachable.
+const probeLossThreshold = 3
+
+// Size of a probe message, which is the message type followed by a 64-bit ID.
+const probeMessageSize = 9
+
+type probeState struct {
+	id        atomic.Uint64 // ID of the outstanding probe, or 0 if answered
+	sent      atomic.Int64  // Unix nanoseconds when the last probe was sent
+	missed    atomic.Uint32 // Number of probes in a row that went unanswered
+	rtt       atomic.Int64  // Round-trip time of the last answered probe
+	lastReply atomic.Int64  // Unix nanoseconds when the last probe was answered
+}
+
+// Returns whether the destination has been marked as unreachable because it
+// stopped answering probes.
+func (p *probeState) failed() bool {
+	return p.missed.Load() >= probeLossThreshold
+}
+
+// Sends probes every ProbeInterval, starting a second after the node starts.
+// While probing is disabled the prober sleeps until the configuration is
+// reloaded, and starts again a second after it is enabled.
+func (k *keyStore) prober() {
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	scheduled := true
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-k.reprobe:
+			if !scheduled && k.ckr.getProbeInterval() > 0 {
+				timer.Reset(time.Second)
+				scheduled = true
+			}
+			continue
+		case <-timer.C:
+		}
+		interval := k.ckr.getProbeInterval()
+		if interval == 0 {
+			scheduled = false
+			continue
+		}
+		for _, state := range k.ckr.getKeyStates() {
+			k.sendProbe(state)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Wakes the prober after the configuration has changed, in case probing has
+// been enabled.
+func (k *keyStore) wakeProber() {
+	select {
+	case k.reprobe <- struct{}{}:
+	default:
+	}
+}
+
+func (k *keyStore) sendProbe(state *keyState) {
+	if state.probe.id.Load() != 0 {
+		missed := state.probe.missed.Add(1)
+		if missed >= probeLossThreshold && state.down.CompareAndSwap(false, true) {
+			k.ckr.log.Warnf("CKR destination %s is not answering probes", hex.EncodeToString(state.key))
+		}
+	}
+	id := rand.Uint64() | 1
+	state.probe.sent.Store(time.Now().UnixNano())
+	state.probe.id.Store(id)
+	msg := make([]byte, probeMessageSize)
+	msg[0] = controlProbeRequest
+	binary.BigEndian.PutUint64(msg[1:], id)
+	_, _ = k.conn.WriteTo(msg, iwt.Addr(state.key))
+}
+
+func (k *keyStore) handleProbeResponse(bs []byte, from ed25519.PublicKey) {
+	if len(bs) < probeMessageSize {
+		return
+	}
+	state := k.ckr.getKeyState(from)
+	if state == nil {
+		return
+	}
+	id := binary.BigEndian.Uint64(bs[1:])
+	if id == 0 || !state.probe.id.CompareAndSwap(id, 0) {
+		return
+	}
+	now := time.Now().UnixNano()
+	state.probe.rtt.Store(now - state.probe.sent.Load())
+	state.probe.lastReply.Store(now)
+	state.probe.missed.Store(0)
+	if state.reachable() {
+		k.ckr.log.Infof("CKR destination %s is reachable again", hex.EncodeToString(state.key))
+	}
+}
@@ -0,0 +1,153 @@
+package ckriprwc
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/neilalexander/yggdrasilckr/src/config"
+)
+
+// ICMP errors that are generated locally are rate limited, both overall and
+// to each destination, so that a flood of bad packets can't turn into a flood
+// of replies. RFC 4443 requires this for ICMPv6.
+const (
+	icmpRateLimit            = 100 // Errors per second
+	icmpDestinationRateLimit = 10  // Errors per second to each destination
+	icmpMaxDestinations      = 4096
+)
+
+// A token bucket that allows up to burst events at once, refilled at rate
+// events per second. It isn't safe for concurrent use.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst}
+}
+
+// Takes a token from the bucket, returning false if there are none left.
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.refill(now)
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Returns a token taken by allow that wasn't used after all.
+func (l *rateLimiter) giveBack() {
+	l.tokens = min(l.tokens+1, l.burst)
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(l.last); l.last.IsZero() || elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+}
+
+// Returns whether the bucket would be full by now, in which case it can be
+// forgotten without changing what is allowed.
+func (l *rateLimiter) full(now time.Time) bool {
+	return l.tokens+now.Sub(l.last).Seconds()*l.rate >= l.burst
+}
+
+type icmpLimiter struct {
+	sync.Mutex
+	global       *rateLimiter
+	rate         float64 // For each destination
+	burst        float64
+	destinations map[netip.Addr]*rateLimiter
+	overflow     *rateLimiter // Shared by destinations that can't be tracked
+	suppressed   atomic.Uint64
+}
+
+// Sets the limits from the configuration, using the defaults for any that
+// aren't set. The buckets start out full.
+func (l *icmpLimiter) configure(cfg config.ICMPRateLimitConfig) {
+	l.Lock()
+	defer l.Unlock()
+	l._configure(cfg)
+}
+
+// Lock must be held.
+func (l *icmpLimiter) _configure(cfg config.ICMPRateLimitConfig) {
+	rate, burst := cfg.Rate, cfg.Burst
+	if rate == 0 {
+		rate = icmpRateLimit
+	}
+	if burst == 0 {
+		burst = rate
+	}
+	drate, dburst := cfg.PerDestinationRate, cfg.PerDestinationBurst
+	if drate == 0 {
+		drate = icmpDestinationRateLimit
+	}
+	if dburst == 0 {
+		dburst = drate
+	}
+	l.global = newRateLimiter(float64(rate), float64(burst))
+	l.rate, l.burst = float64(drate), float64(dburst)
+	l.destinations = make(map[netip.Addr]*rateLimiter)
+	l.overflow = newRateLimiter(l.rate, l.burst)
+}
+
+// Returns whether an ICMP error can be sent to the destination, counting it
+// as suppressed if not. The destination's own limit is checked first so that
+// one busy destination doesn't use up the overall limit, and its token is
+// given back if the overall limit is reached.
+func (l *icmpLimiter) allow(dst netip.Addr, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.global == nil {
+		l._configure(config.ICMPRateLimitConfig{})
+	}
+	var d *rateLimiter
+	if dst.IsValid() {
+		if d = l._destination(dst, now); !d.allow(now) {
+			l.suppressed.Add(1)
+			return false
+		}
+	}
+	if !l.global.allow(now) {
+		if d != nil {
+			d.giveBack()
+		}
+		l.suppressed.Add(1)
+		return false
+	}
+	return true
+}
+
+// Returns the bucket for the destination. If too many destinations are being
+// tracked then the ones with full buckets are forgotten first, and if that
+// isn't enough then the overflow bucket is returned, which all of the
+// destinations that aren't tracked share. Lock must be held.
+func (l *icmpLimiter) _destination(dst netip.Addr, now time.Time) *rateLimiter {
+	if d := l.destinations[dst]; d != nil {
+		return d
+	}
+	d := newRateLimiter(l.rate, l.burst)
+	if len(l.destinations) >= icmpMaxDestinations {
+		for addr, d := range l.destinations {
+			if d.full(now) {
+				delete(l.destinations, addr)
+			}
+		}
+		if len(l.destinations) >= icmpMaxDestinations {
+			return l.overflow
+		}
+	}
+	l.destinations[dst] = d
+	return d
+}
@@ -0,0 +1,100 @@
+package ckriprwc
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Traffic from remote nodes is checked against the CKR routes for its source
+// address, in one of these modes. Routes can override the global mode for
+// sources that they match.
+type rpfMode int
+
+const (
+	rpfDefault rpfMode = iota // Use the global mode
+	rpfStrict                 // The source must be routed via the sending node
+	rpfLoose                  // The source must be routed via any node
+	rpfOff                    // Any source is accepted from nodes used by routes
+)
+
+func (m rpfMode) String() string {
+	switch m {
+	case rpfStrict:
+		return "strict"
+	case rpfLoose:
+		return "loose"
+	case rpfOff:
+		return "off"
+	}
+	return ""
+}
+
+func parseRPFMode(s string) (rpfMode, error) {
+	switch s {
+	case "":
+		return rpfDefault, nil
+	case "strict":
+		return rpfStrict, nil
+	case "loose":
+		return rpfLoose, nil
+	case "off":
+		return rpfOff, nil
+	}
+	return rpfDefault, fmt.Errorf("unknown reverse path filter mode %q", s)
+}
+
+// The reasons that traffic from remote nodes can be rejected for.
+type rejectReason int
+
+const (
+	rejectNoRoute          rejectReason = iota // No route for the source
+	rejectWrongKey                             // The source is routed via another node
+	rejectUnknownKey                           // The sending node isn't used by any route
+	rejectDenied                               // Denied by the route's rules or connection tracking
+	rejectYggdrasilRouting                     // From a Yggdrasil address while YggdrasilRouting is disabled
+	rejectOversize                             // Larger than the MTU
+	rejectTranslation                          // The source address couldn't be translated
+	rejectMasquerade                           // The packet couldn't be masqueraded
+	rejectFirewall                             // Denied by the Yggdrasil firewall
+	rejectReasons
+)
+
+func (r rejectReason) String() string {
+	switch r {
+	case rejectNoRoute:
+		return "no_route"
+	case rejectWrongKey:
+		return "wrong_key"
+	case rejectUnknownKey:
+		return "unknown_key"
+	case rejectDenied:
+		return "denied"
+	case rejectYggdrasilRouting:
+		return "yggdrasil_routing"
+	case rejectOversize:
+		return "oversize"
+	case rejectTranslation:
+		return "translation"
+	case rejectMasquerade:
+		return "masquerade"
+	case rejectFirewall:
+		return "firewall"
+	}
+	return "unknown"
+}
+
+// Counts of rejected packets by reason.
+type rejectCounters [rejectReasons]atomic.Uint64
+
+func (r *rejectCounters) add(reason rejectReason) {
+	r[reason].Add(1)
+}
+
+// Returns the counts of rejected packets by the name of the reason.
+func (r *rejectCounters) get() map[string]uint64 {
+	counts := make(map[string]uint64, rejectReasons)
+	for i := range r {
+		counts[rejectReason(i).String()] = r[i].Load()
+	}
+	return counts
+}
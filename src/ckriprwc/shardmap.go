@@ -0,0 +1,110 @@
+package ckriprwc
+
+import (
+	"hash/maphash"
+	"iter"
+	"maps"
+	"sync/atomic"
+)
+
+// The number of shards in a shardedMap. Each write copies one shard, so more
+// shards make writes cheaper at the cost of slower iteration.
+const mapShards = 64
+
+// A map for data that is read far more often than it is written, such as the
+// keys of the nodes that packets are exchanged with. Each shard is an
+// immutable map that is replaced whenever it changes, so lookups never take a
+// lock and never contend with each other. Writes must be serialized by the
+// caller.
+type shardedMap[K comparable, V any] struct {
+	seed   maphash.Seed
+	shards [mapShards]atomic.Pointer[map[K]V]
+}
+
+func newShardedMap[K comparable, V any]() *shardedMap[K, V] {
+	return &shardedMap[K, V]{seed: maphash.MakeSeed()}
+}
+
+func (m *shardedMap[K, V]) index(key K) uint64 {
+	return maphash.Comparable(m.seed, key) % mapShards
+}
+
+func (m *shardedMap[K, V]) shard(key K) *atomic.Pointer[map[K]V] {
+	return &m.shards[m.index(key)]
+}
+
+func (m *shardedMap[K, V]) get(key K) (v V) {
+	if s := m.shard(key).Load(); s != nil {
+		v = (*s)[key]
+	}
+	return v
+}
+
+// Writes must be serialized by the caller.
+func (m *shardedMap[K, V]) set(key K, v V) {
+	shard := m.shard(key)
+	var s map[K]V
+	if old := shard.Load(); old != nil {
+		s = maps.Clone(*old)
+	} else {
+		s = make(map[K]V, 1)
+	}
+	s[key] = v
+	shard.Store(&s)
+}
+
+// Removes the entries for the given keys for which f returns true, copying
+// each shard that has any of them only once. Writes must be serialized by the
+// caller.
+func (m *shardedMap[K, V]) deleteKeys(keys []K, f func(K, V) bool) {
+	var copied [mapShards]map[K]V
+	for _, key := range keys {
+		i := m.index(key)
+		s := copied[i]
+		if s == nil {
+			if old := m.shards[i].Load(); old != nil {
+				s = *old
+			}
+		}
+		if v, ok := s[key]; !ok || !f(key, v) {
+			continue
+		}
+		if copied[i] == nil {
+			s = maps.Clone(s)
+			copied[i] = s
+		}
+		delete(s, key)
+	}
+	for i, s := range copied {
+		if s != nil {
+			m.shards[i].Store(&s)
+		}
+	}
+}
+
+func (m *shardedMap[K, V]) len() (n int) {
+	for i := range m.shards {
+		if s := m.shards[i].Load(); s != nil {
+			n += len(*s)
+		}
+	}
+	return n
+}
+
+// Iterates over a snapshot of each shard in turn, so writes made during the
+// iteration may or may not be seen.
+func (m *shardedMap[K, V]) all() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		for i := range m.shards {
+			s := m.shards[i].Load()
+			if s == nil {
+				continue
+			}
+			for k, v := range *s {
+				if !yield(k, v) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package ckriprwc
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// Routes can have an alias, in which case the route is used for traffic to
+// the alias prefix and addresses are translated 1:1 between it and the
+// prefix that is really in use at the remote side. This allows several remote
+// sites that use the same private addresses to be reached at once. IPv4
+// packets have their checksums updated, and IPv6 prefixes are translated as
+// described in RFC 6296 so that the checksums don't change.
+
+// Parses the subnet and alias of a route, which must be the same size.
+func parseAlias(subnet, alias string) (remote, local netip.Prefix, err error) {
+	if remote, err = netip.ParsePrefix(subnet); err != nil {
+		return
+	}
+	if local, err = netip.ParsePrefix(alias); err != nil {
+		return
+	}
+	remote, local = remote.Masked(), local.Masked()
+	switch {
+	case remote.Addr().Is4() != local.Addr().Is4():
+		err = fmt.Errorf("alias %s is not the same address family", local)
+	case remote.Bits() != local.Bits():
+		err = fmt.Errorf("alias %s is not the same size", local)
+	case remote.Addr().Is6() && remote.Bits() > 64:
+		err = fmt.Errorf("IPv6 prefixes longer than /64 can't be translated")
+	case remote.Overlaps(local):
+		err = fmt.Errorf("alias %s overlaps the subnet", local)
+	}
+	return
+}
+
+// Returns the address with the from prefix replaced with the to prefix. For
+// IPv6 the address is also adjusted so that the checksum of the address is
+// unchanged, which isn't possible for some addresses.
+func mapAddress(addr netip.Addr, from, to netip.Prefix) (netip.Addr, bool) {
+	a, t := addr.As16(), to.Addr().As16()
+	bits := to.Bits()
+	if addr.Is4() {
+		bits += 96
+	}
+	n := bits / 8
+	copy(a[:n], t[:n])
+	if r := bits % 8; r != 0 {
+		mask := byte(0xff << (8 - r))
+		a[n] = a[n]&^mask | t[n]&mask
+	}
+	if addr.Is4() {
+		return netip.AddrFrom16(a).Unmap(), true
+	}
+	// Add the difference between the sums of the prefixes to a word outside
+	// of the prefix, which is the subnet ID if there is room or otherwise the
+	// first word of the interface ID that isn't 0xffff.
+	word := 3
+	if bits > 48 {
+		for word = 4; word < 8 && binary.BigEndian.Uint16(a[word*2:]) == 0xffff; word++ {
+		}
+		if word == 8 {
+			return netip.Addr{}, false
+		}
+	}
+	f := from.Addr().As16()
+	s := uint32(binary.BigEndian.Uint16(a[word*2:]))
+	for i := 0; i < 8; i += 2 {
+		s += uint32(binary.BigEndian.Uint16(f[i:])) + uint32(^binary.BigEndian.Uint16(t[i:]))
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	if s == 0xffff {
+		s = 0
+	}
+	binary.BigEndian.PutUint16(a[word*2:], uint16(s))
+	return netip.AddrFrom16(a), true
+}
+
+// Translates the source or destination address of the packet from one prefix
+// to the other, if it is in the from prefix. The opposite address of a packet
+// quoted in an ICMP error is translated too, even if the error came from a
+// router outside of the prefix. Returns false if the address can't be
+// translated.
+func translatePacket(bs []byte, source bool, from, to netip.Prefix) bool {
+	f, ok := parsePacketFields(bs)
+	if !ok {
+		return false
+	}
+	addr := f.dst
+	if source {
+		addr = f.src
+	}
+	translated := false
+	if from.Contains(addr) {
+		mapped, ok := mapAddress(addr, from, to)
+		if !ok {
+			return false
+		}
+		natRewriteAddr(bs, &f, source, mapped)
+		translated = true
+	}
+	if isICMPError(&f) {
+		inner := bs[f.transport+8:]
+		if fi, ok := parsePacketFields(inner); ok {
+			addr := fi.src
+			if source {
+				addr = fi.dst
+			}
+			if from.Contains(addr) {
+				if mapped, ok := mapAddress(addr, from, to); ok {
+					natRewriteAddr(inner, &fi, !source, mapped)
+					translated = true
+				}
+			}
+		}
+		if translated {
+			icmpChecksum(bs, &f)
+		}
+	}
+	return true
+}
+
+// Translates the source of a packet from the node with the given key, if it
+// is in the remote prefix of an aliased route via that node. ICMP errors can
+// come from routers outside of the remote prefix, so they are also matched by
+// the destination of the packet that they quote. Returns false if the packet
+// should be dropped.
+func (c *cryptokey) translateInbound(bs []byte, src netip.Addr, key ed25519.PublicKey) bool {
+	var k keyArray
+	copy(k[:], key)
+	routes := c.routes().aliases[k]
+	if len(routes) == 0 {
+		return true
+	}
+	for _, r := range routes {
+		if r.remote.Contains(src) {
+			return translatePacket(bs, true, r.remote, r.prefix)
+		}
+	}
+	if f, ok := parsePacketFields(bs); ok && isICMPError(&f) {
+		if fi, ok := parsePacketFields(bs[f.transport+8:]); ok {
+			for _, r := range routes {
+				if r.remote.Contains(fi.dst) {
+					return translatePacket(bs, true, r.remote, r.prefix)
+				}
+			}
+		}
+	}
+	return true
+}
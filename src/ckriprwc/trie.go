@@ -0,0 +1,227 @@
+package ckriprwc
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// The route trie is a path-compressed binary trie which is used to find the
+// longest matching CKR prefix for an address. Each node either holds routes
+// or is a "glue" node that exists only to join two diverging branches, so the
+// number of nodes visited on a lookup is bounded by the number of distinct
+// prefix lengths on the path to the address and not by the table size. A node
+// holds more than one route when routes for the same prefix are limited to
+// different source prefixes.
+
+type trieKey struct {
+	hi, lo uint64
+}
+
+// Converts an address into a trie key. IPv4 addresses occupy the top 32 bits
+// of the key so that both families can share the same bit arithmetic.
+func trieKeyFromAddr(addr netip.Addr) trieKey {
+	if addr.Is4() {
+		b := addr.As4()
+		return trieKey{hi: uint64(binary.BigEndian.Uint32(b[:])) << 32}
+	}
+	b := addr.As16()
+	return trieKey{
+		hi: binary.BigEndian.Uint64(b[:8]),
+		lo: binary.BigEndian.Uint64(b[8:]),
+	}
+}
+
+// Returns the bit at position i, counting from the most significant bit.
+func (k trieKey) bit(i int) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+// Returns the number of leading bits that the two keys have in common.
+func (k trieKey) commonBits(o trieKey) int {
+	if x := k.hi ^ o.hi; x != 0 {
+		return bits.LeadingZeros64(x)
+	}
+	return 64 + bits.LeadingZeros64(k.lo^o.lo)
+}
+
+// Returns the key with all bits beyond the first n cleared.
+func (k trieKey) masked(n int) trieKey {
+	switch {
+	case n <= 0:
+		return trieKey{}
+	case n < 64:
+		return trieKey{hi: k.hi &^ (^uint64(0) >> n)}
+	case n < 128:
+		return trieKey{hi: k.hi, lo: k.lo &^ (^uint64(0) >> (n - 64))}
+	default:
+		return k
+	}
+}
+
+type trieNode struct {
+	key      trieKey
+	bits     int
+	routes   []*route // Most specific source first, empty for glue nodes
+	children [2]*trieNode
+}
+
+type routeTrie struct {
+	root *trieNode
+	size int
+}
+
+// Returns a trie containing the given routes.
+func newRouteTrie(routes []*route) routeTrie {
+	var t routeTrie
+	for _, r := range routes {
+		t.insert(r)
+	}
+	return t
+}
+
+// Inserts the route into the trie under its prefix, which must already be
+// masked. Returns false if a route already exists for that prefix and source.
+func (t *routeTrie) insert(r *route) bool {
+	key, plen := trieKeyFromAddr(r.prefix.Addr()), r.prefix.Bits()
+	for n := &t.root; ; {
+		node := *n
+		if node == nil {
+			*n = &trieNode{key: key, bits: plen, routes: []*route{r}}
+			t.size++
+			return true
+		}
+		common := min(key.commonBits(node.key), plen, node.bits)
+		switch {
+		case common == plen && common == node.bits:
+			// The node already exists, possibly as a glue node.
+			return t.addToNode(node, r)
+
+		case common == node.bits:
+			// The node is a shorter prefix of the new route, so descend.
+			n = &node.children[key.bit(common)]
+
+		case common == plen:
+			// The new route is a shorter prefix of the node, so it takes
+			// the node's place and the node becomes its child.
+			nn := &trieNode{key: key, bits: plen, routes: []*route{r}}
+			nn.children[node.key.bit(common)] = node
+			*n = nn
+			t.size++
+			return true
+
+		default:
+			// The new route and the node diverge, so join them together
+			// under a glue node at the point where they differ.
+			glue := &trieNode{key: key.masked(common), bits: common}
+			glue.children[key.bit(common)] = &trieNode{key: key, bits: plen, routes: []*route{r}}
+			glue.children[node.key.bit(common)] = node
+			*n = glue
+			t.size++
+			return true
+		}
+	}
+}
+
+// Adds the route to an existing node, keeping the most specific sources
+// first. Returns false if the node already has a route for the same source.
+func (t *routeTrie) addToNode(node *trieNode, r *route) bool {
+	i := 0
+	for ; i < len(node.routes); i++ {
+		if node.routes[i].source == r.source {
+			return false
+		}
+		if node.routes[i].sourceBits() < r.sourceBits() {
+			break
+		}
+	}
+	node.routes = append(node.routes[:i:i], append([]*route{r}, node.routes[i:]...)...)
+	t.size++
+	return true
+}
+
+// Returns the node for the exact given prefix, or nil if there isn't one.
+func (t *routeTrie) node(prefix netip.Prefix) *trieNode {
+	key, plen := trieKeyFromAddr(prefix.Addr()), prefix.Bits()
+	for n := t.root; n != nil; {
+		if n.bits > plen || key.commonBits(n.key) < n.bits {
+			return nil
+		}
+		if n.bits == plen {
+			return n
+		}
+		n = n.children[key.bit(n.bits)]
+	}
+	return nil
+}
+
+// Returns the route for the exact given prefix and source, or nil if there
+// isn't one.
+func (t *routeTrie) get(prefix, source netip.Prefix) *route {
+	if n := t.node(prefix); n != nil {
+		for _, r := range n.routes {
+			if r.source == source {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// Returns whether there are any routes for the exact given prefix.
+func (t *routeTrie) has(prefix netip.Prefix) bool {
+	n := t.node(prefix)
+	return n != nil && len(n.routes) > 0
+}
+
+// Removes the route for the exact given prefix and source. The node is left
+// in place, even if it has no routes left, until the trie is rebuilt.
+func (t *routeTrie) remove(prefix, source netip.Prefix) bool {
+	n := t.node(prefix)
+	if n == nil {
+		return false
+	}
+	for i, r := range n.routes {
+		if r.source == source {
+			n.routes = append(n.routes[:i:i], n.routes[i+1:]...)
+			t.size--
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the route with the longest prefix containing the destination
+// address whose source prefix, if any, contains the source address. Where a
+// prefix has several routes, the one with the most specific matching source
+// is chosen. If none of them match then shorter prefixes are tried instead.
+func (t *routeTrie) lookup(dst, src netip.Addr) *route {
+	key := trieKeyFromAddr(dst)
+	var path [129]*trieNode
+	depth := 0
+	for n := t.root; n != nil; {
+		if key.commonBits(n.key) < n.bits {
+			break
+		}
+		if len(n.routes) > 0 {
+			path[depth] = n
+			depth++
+		}
+		if n.bits >= 128 {
+			break
+		}
+		n = n.children[key.bit(n.bits)]
+	}
+	for depth > 0 {
+		depth--
+		for _, r := range path[depth].routes {
+			if r.matchesSource(src) {
+				return r
+			}
+		}
+	}
+	return nil
+}
@@ -17,12 +17,98 @@ type NodeConfig struct {
 // TunnelRoutingConfig contains the crypto-key routing tables for tunneling regular
 // IPv4 or IPv6 subnets across the Yggdrasil network.
 type TunnelRoutingConfig struct {
-	InstallRoutes     bool                `comment:"Install system routing table entries automatically (Linux and\nmacOS only)."`
-	YggdrasilRouting  bool                `comment:"Enable or disable routing of Yggdrasil IPv6 addresses/subnets."`
-	Addresses         []string            `comment:"Interface addresses to configure before installing routes, e.g.\n[ \"a.b.c.1/24\", \"aaaa:bbbb:cccc::1/e\" ] (Linux and macOS only)."`
-	RemoteSubnets     map[string][]string `comment:"IPv4 or IPv6 subnets belonging to remote nodes by public key, e.g.\n{ \"boxpubkey\": [ \"a.b.c.d/e\", \"aaaa:bbbb:cccc::/e\" ] }"`
-	IPv6RemoteSubnets map[string]string   `json:"-" comment:"IPv6 subnets belonging to remote nodes, mapped to the node's public\nkey, e.g. { \"aaaa:bbbb:cccc::/e\": \"boxpubkey\", ... }"`
-	IPv4RemoteSubnets map[string]string   `json:"-" comment:"IPv4 subnets belonging to remote nodes, mapped to the node's public\nkey, e.g. { \"a.b.c.d/e\": \"boxpubkey\", ... }"`
+	InstallRoutes         bool                    `comment:"Install system routing table entries automatically (Linux and\nmacOS only)."`
+	YggdrasilRouting      bool                    `comment:"Enable or disable routing of Yggdrasil IPv6 addresses/subnets."`
+	YggdrasilFirewall     YggdrasilFirewallConfig `comment:"Restrict which native Yggdrasil traffic other nodes can send to this\nnode. When enabled, only replies to traffic sent from this node and\ntraffic allowed by the rules is accepted."`
+	YggdrasilAllowed      []string                `comment:"Public keys or Yggdrasil IPv6 prefixes of nodes that can still exchange\nnative Yggdrasil traffic with this node when YggdrasilRouting is\ndisabled, e.g. [ \"boxpubkey\", \"200:1111:2222:3333::/64\" ]"`
+	Addresses             []string                `comment:"Interface addresses to configure before installing routes, e.g.\n[ \"a.b.c.1/24\", \"aaaa:bbbb:cccc::1/e\" ] (Linux and macOS only)."`
+	RemoteSubnets         map[string][]string     `comment:"IPv4 or IPv6 subnets belonging to remote nodes by public key, e.g.\n{ \"boxpubkey\": [ \"a.b.c.d/e\", \"aaaa:bbbb:cccc::/e\" ] }"`
+	Routes                []RouteConfig           `comment:"IPv4 or IPv6 subnets that can be reached through more than one remote\nnode. Destinations with lower priority values are preferred and traffic\nwill fail over to the next destination if they stop responding. Flows are\nspread across destinations with the same priority by weight. If a Source\nsubnet is given then the route only applies to traffic from it, e.g.\n[ { Subnet: \"a.b.c.d/e\", Source: \"\", Destinations: [ { Key: \"boxpubkey\", Priority: 0, Weight: 1 } ] } ]"`
+	ProbeInterval         uint64                  `comment:"How often, in seconds, to probe each remote node used by CKR routes\nto check that it is reachable and to measure the round-trip time. The\nremote nodes must also be running yggdrasilckr. Set to 0 to disable."`
+	PathWarmupInterval    uint64                  `comment:"How often, in seconds, to look up the paths to each remote node used\nby CKR routes, starting as soon as this node starts, so that they are\nalready known when traffic is first sent and don't go stale while it is\nidle. Set to 0 to disable."`
+	LocalSubnets          []string                `comment:"IPv4 or IPv6 subnets that are reachable through this node, which will\nbe advertised to the nodes in AdvertisementPeers, e.g.\n[ \"a.b.c.d/e\", \"aaaa:bbbb:cccc::/e\" ]"`
+	AdvertisementPeers    []string                `comment:"Public keys of remote nodes to exchange LocalSubnets with. Subnets\nadvertised by these nodes are routed to them automatically, unless a\nroute for the same subnet is configured, and are removed again if the\nnode stops advertising them. The remote nodes must also be running\nyggdrasilckr."`
+	AdvertisementPrefixes map[string][]string     `comment:"Subnets that each of the AdvertisementPeers may advertise, by public\nkey. Advertised subnets must fall within one of them. Peers that aren't\nlisted may only advertise IPv4 subnets of /8 or longer and IPv6 subnets\nof /16 or longer, so shorter subnets such as a default route are only\naccepted if they are listed here, e.g.\n{ \"boxpubkey\": [ \"a.b.c.d/e\", \"0.0.0.0/0\" ] }"`
+	ConntrackMaxEntries   uint64                  `comment:"Maximum number of flows to track for stateful routes. When the table\nis full, the least recently used flow is forgotten. Defaults to 65536."`
+	ReversePathFilter     string                  `comment:"How to check the source of traffic from remote nodes. \"strict\" only\naccepts it from the node that replies would be sent to, \"loose\" from\nany node if there is a route for the source, and \"off\" from any node\nused by a route. Defaults to strict."`
+	KeyStore              KeyStoreConfig          `comment:"How long to cache the keys of remote nodes that native Yggdrasil\ntraffic is exchanged with, and to buffer packets while looking keys up,\nin seconds, and how many of each to keep. The least recently used are\nevicted when there are too many. Defaults to 120 seconds and 65536 keys,\nand 120 seconds and 4096 destinations with buffered packets."`
+	ICMPRateLimit         ICMPRateLimitConfig     `comment:"Limits on the ICMP errors that this node generates, in messages per\nsecond overall and to each destination. Bursts default to the rates,\nwhich default to 100 overall and 10 to each destination."`
+	Masquerade            bool                    `comment:"Rewrite the source of traffic from remote nodes to the first IPv4 or\nIPv6 address in Addresses, so that this node can be used as an exit\nwithout kernel NAT. Only TCP, UDP and ICMP echo traffic is forwarded."`
+	IPv6RemoteSubnets     map[string]string       `json:"-" comment:"IPv6 subnets belonging to remote nodes, mapped to the node's public\nkey, e.g. { \"aaaa:bbbb:cccc::/e\": \"boxpubkey\", ... }"`
+	IPv4RemoteSubnets     map[string]string       `json:"-" comment:"IPv4 subnets belonging to remote nodes, mapped to the node's public\nkey, e.g. { \"a.b.c.d/e\": \"boxpubkey\", ... }"`
+}
+
+// RouteConfig describes a CKR route to a subnet via one or more remote nodes.
+// If Source is set then the route only applies to traffic from that subnet,
+// and takes precedence over routes to the same subnet with a less specific
+// source or no source at all.
+type RouteConfig struct {
+	Subnet            string
+	Source            string
+	Destinations      []RouteDestinationConfig
+	Rules             []RuleConfig
+	Stateful          bool   // Only accept traffic from the remote nodes for flows started from this side
+	Alias             string // Local subnet of the same size to use for Subnet, translating addresses between them
+	ReversePathFilter string // Overrides the global ReversePathFilter for sources matching this route
+	Type              string // "blackhole" to discard traffic, "unreachable" or "prohibit" to reject it with ICMP, or empty to forward it to Destinations
+}
+
+// RouteDestinationConfig describes a remote node that a CKR route can use.
+type RouteDestinationConfig struct {
+	Key      string
+	Priority int
+	Weight   int
+}
+
+// RuleConfig describes a rule that restricts which traffic may use a CKR
+// route. Rules are checked in order and the first matching rule decides
+// whether a packet is allowed. Empty fields match everything.
+type RuleConfig struct {
+	Action      string   // "allow" or "deny"
+	Direction   string   // "in" for traffic from the remote nodes, "out" for traffic to them, or "both"
+	Protocol    string   // "tcp", "udp", "sctp", "icmp", "icmpv6" or a protocol number
+	LocalSubnet string   // Subnet that the address on this side must be in
+	LocalPorts  []string // Ports on this side, e.g. [ "443", "8000-8080" ]
+	RemotePorts []string // Ports on the remote side
+	ICMPTypes   []int
+}
+
+// YggdrasilFirewallConfig describes which native Yggdrasil traffic from other
+// nodes is accepted.
+type YggdrasilFirewallConfig struct {
+	Enabled bool
+	Rules   []YggdrasilFirewallRuleConfig
+}
+
+// YggdrasilFirewallRuleConfig describes a rule of the Yggdrasil firewall. Rules
+// are checked in order and the first matching rule decides whether a packet
+// is allowed. Empty fields match everything.
+type YggdrasilFirewallRuleConfig struct {
+	Action      string   // "allow" or "deny", defaults to "allow"
+	Sources     []string // Public keys or Yggdrasil prefixes of the sending nodes
+	Protocol    string   // "tcp", "udp", "sctp", "icmp" or a protocol number
+	LocalPorts  []string // Ports on this node, e.g. [ "22", "8000-8080" ]
+	RemotePorts []string
+	ICMPTypes   []int
+}
+
+// KeyStoreConfig describes how long the keys of remote nodes are cached and
+// packets to them are buffered, and how many of each are kept. Zero values
+// use the defaults.
+type KeyStoreConfig struct {
+	KeyTTL     uint64 // Seconds to keep the key of a node that no traffic is exchanged with
+	PendingTTL uint64 // Seconds to buffer packets while looking up a key
+	MaxKeys    uint64
+	MaxPending uint64 // Destinations with buffered packets
+}
+
+// ICMPRateLimitConfig describes the token buckets that limit how many ICMP
+// errors are generated. Zero values use the defaults.
+type ICMPRateLimitConfig struct {
+	Rate                uint64 // Messages per second across all destinations
+	Burst               uint64 // Messages that can be sent at once across all destinations
+	PerDestinationRate  uint64 // Messages per second to each destination
+	PerDestinationBurst uint64 // Messages that can be sent at once to each destination
 }
 
 func (cfg *NodeConfig) ReadFrom(r io.Reader) (int64, error) {
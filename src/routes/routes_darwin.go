@@ -16,13 +16,30 @@ import (
 	"github.com/yggdrasil-network/yggdrasil-go/src/tun"
 )
 
-func SetAddresses(tun *tun.TunAdapter, log *log.Logger, addresses []string) error {
+// SetAddresses adds the addresses to the TUN adapter. It returns the addresses
+// that weren't added, which are also logged.
+func SetAddresses(tun *tun.TunAdapter, log *log.Logger, addresses []string) ([]string, error) {
+	var failed []string
 	for _, cidr := range addresses {
 		if err := addAddressDarwin(tun, cidr); err != nil {
 			log.Warnln("Failed to add address", cidr, "to interface:", err)
+			failed = append(failed, cidr)
 		}
 	}
-	return nil
+	return failed, nil
+}
+
+// RemoveAddresses removes the addresses from the TUN adapter, in the same way
+// as SetAddresses adds them.
+func RemoveAddresses(tun *tun.TunAdapter, log *log.Logger, addresses []string) ([]string, error) {
+	var failed []string
+	for _, cidr := range addresses {
+		if err := removeAddressDarwin(tun, cidr); err != nil {
+			log.Warnln("Failed to remove address", cidr, "from interface:", err)
+			failed = append(failed, cidr)
+		}
+	}
+	return failed, nil
 }
 
 func SetRoutes(tun *tun.TunAdapter, log *log.Logger, cidrs []string) error {
@@ -45,6 +62,29 @@ func SetRoutes(tun *tun.TunAdapter, log *log.Logger, cidrs []string) error {
 	return nil
 }
 
+func AddRoute(tun *tun.TunAdapter, log *log.Logger, cidr string) error {
+	return changeRouteDarwin(tun, cidr, unix.RTM_ADD)
+}
+
+func RemoveRoute(tun *tun.TunAdapter, log *log.Logger, cidr string) error {
+	return changeRouteDarwin(tun, cidr, unix.RTM_DELETE)
+}
+
+func changeRouteDarwin(tun *tun.TunAdapter, cidr string, typ int) error {
+	iface, err := net.InterfaceByName(tun.Name())
+	if err != nil {
+		return fmt.Errorf("failed to find link by name: %w", err)
+	}
+
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("failed to open routing socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	return routeDarwin(fd, iface, cidr, 1, typ)
+}
+
 func addAddressDarwin(tun *tun.TunAdapter, cidr string) error {
 	ip, ipnet, err := net.ParseCIDR(cidr)
 	if err != nil {
@@ -64,7 +104,54 @@ func addAddressDarwin(tun *tun.TunAdapter, cidr string) error {
 	return nil
 }
 
+func removeAddressDarwin(tun *tun.TunAdapter, cidr string) error {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("couldn't parse CIDR %q: %w", cidr, err)
+	}
+	iface, err := net.InterfaceByName(tun.Name())
+	if err != nil {
+		return fmt.Errorf("failed to find link by name: %w", err)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open AF_INET socket: %w", err)
+		}
+		defer unix.Close(fd)
+
+		var ifr inIfReq
+		copy(ifr.IfrName[:], iface.Name)
+		ifr.IfrAddr = sockAddrInet4FromIP(ip4)
+
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(syscall.SIOCDIFADDR), uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+			return fmt.Errorf("failed to call SIOCDIFADDR: %w", errno)
+		}
+		return nil
+	}
+
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open AF_INET6 socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	var ifr in6IfReq
+	copy(ifr.IfrName[:], iface.Name)
+	ifr.IfrAddr = sockAddrInet6FromIP(ip.To16())
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(darwin_SIOCDIFADDR_IN6), uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return fmt.Errorf("failed to call SIOCDIFADDR_IN6: %w", errno)
+	}
+	return nil
+}
+
 func addRouteDarwin(fd int, iface *net.Interface, cidr string, seq int) error {
+	return routeDarwin(fd, iface, cidr, seq, unix.RTM_ADD)
+}
+
+func routeDarwin(fd int, iface *net.Interface, cidr string, seq int, typ int) error {
 	_, ipnet, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return fmt.Errorf("couldn't parse CIDR %q: %w", cidr, err)
@@ -72,7 +159,7 @@ func addRouteDarwin(fd int, iface *net.Interface, cidr string, seq int) error {
 
 	msg := &route.RouteMessage{
 		Version: syscall.RTM_VERSION,
-		Type:    unix.RTM_ADD,
+		Type:    typ,
 		Flags:   syscall.RTF_UP | syscall.RTF_STATIC,
 		ID:      uintptr(os.Getpid()),
 		Seq:     seq,
@@ -104,7 +191,7 @@ func addRouteDarwin(fd int, iface *net.Interface, cidr string, seq int) error {
 		return fmt.Errorf("couldn't marshal route %q: %w", cidr, err)
 	}
 	if _, err := unix.Write(fd, b); err != nil {
-		return fmt.Errorf("couldn't add route %q: %w", cidr, err)
+		return fmt.Errorf("couldn't write route %q: %w", cidr, err)
 	}
 
 	var ackBuf [4096]byte
@@ -205,6 +292,17 @@ type in6AliasReq struct {
 	IfraLifetime   in6AddrLifetime
 }
 
+type inIfReq struct {
+	IfrName [syscall.IFNAMSIZ]byte
+	IfrAddr syscall.RawSockaddrInet4
+}
+
+type in6IfReq struct {
+	IfrName [syscall.IFNAMSIZ]byte
+	IfrAddr syscall.RawSockaddrInet6
+	_       [244]byte // Remainder of the ifr_ifru union
+}
+
 type in6AddrLifetime struct {
 	Ia6tExpire    float64
 	Ia6tPreferred float64
@@ -214,6 +312,7 @@ type in6AddrLifetime struct {
 
 const (
 	darwin_SIOCAIFADDR_IN6       = 2155899162
+	darwin_SIOCDIFADDR_IN6       = 2166384921
 	darwin_IN6_IFF_NODAD         = 0x0020
 	darwin_IN6_IFF_SECURED       = 0x0400
 	darwin_ND6_INFINITE_LIFETIME = 0xFFFFFFFF
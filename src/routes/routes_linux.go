@@ -11,21 +11,47 @@ import (
 	"github.com/yggdrasil-network/yggdrasil-go/src/tun"
 )
 
-func SetAddresses(tun *tun.TunAdapter, log *log.Logger, addresses []string) error {
+// SetAddresses adds the addresses to the TUN adapter. It returns the addresses
+// that weren't added, which are also logged, and an error if the rest couldn't
+// be tried.
+func SetAddresses(tun *tun.TunAdapter, log *log.Logger, addresses []string) ([]string, error) {
 	nlintf, err := netlink.LinkByName(tun.Name())
 	if err != nil {
-		return fmt.Errorf("failed to find link by name: %w", err)
+		return addresses, fmt.Errorf("failed to find link by name: %w", err)
 	}
-	for _, addr := range addresses {
+	var failed []string
+	for i, addr := range addresses {
 		nladdr, err := netlink.ParseAddr(addr)
 		if err != nil {
-			return fmt.Errorf("couldn't parse CIDR %q: %w", addr, err)
+			return append(failed, addresses[i:]...), fmt.Errorf("couldn't parse CIDR %q: %w", addr, err)
 		}
 		if err := netlink.AddrAdd(nlintf, nladdr); err != nil {
 			log.Warnln("Failed to add address", addr, "to interface:", err)
+			failed = append(failed, addr)
 		}
 	}
-	return nil
+	return failed, nil
+}
+
+// RemoveAddresses removes the addresses from the TUN adapter, in the same way
+// as SetAddresses adds them.
+func RemoveAddresses(tun *tun.TunAdapter, log *log.Logger, addresses []string) ([]string, error) {
+	nlintf, err := netlink.LinkByName(tun.Name())
+	if err != nil {
+		return addresses, fmt.Errorf("failed to find link by name: %w", err)
+	}
+	var failed []string
+	for i, addr := range addresses {
+		nladdr, err := netlink.ParseAddr(addr)
+		if err != nil {
+			return append(failed, addresses[i:]...), fmt.Errorf("couldn't parse CIDR %q: %w", addr, err)
+		}
+		if err := netlink.AddrDel(nlintf, nladdr); err != nil {
+			log.Warnln("Failed to remove address", addr, "from interface:", err)
+			failed = append(failed, addr)
+		}
+	}
+	return failed, nil
 }
 
 func SetRoutes(tun *tun.TunAdapter, log *log.Logger, cidrs []string) error {
@@ -48,3 +74,41 @@ func SetRoutes(tun *tun.TunAdapter, log *log.Logger, cidrs []string) error {
 	}
 	return nil
 }
+
+func AddRoute(tun *tun.TunAdapter, log *log.Logger, cidr string) error {
+	nlroute, err := linkRoute(tun, cidr)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteAdd(nlroute); err != nil {
+		return fmt.Errorf("failed to add route %q: %w", cidr, err)
+	}
+	return nil
+}
+
+func RemoveRoute(tun *tun.TunAdapter, log *log.Logger, cidr string) error {
+	nlroute, err := linkRoute(tun, cidr)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteDel(nlroute); err != nil {
+		return fmt.Errorf("failed to remove route %q: %w", cidr, err)
+	}
+	return nil
+}
+
+func linkRoute(tun *tun.TunAdapter, cidr string) (*netlink.Route, error) {
+	nlintf, err := netlink.LinkByName(tun.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to find link by name: %w", err)
+	}
+	nladdr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse CIDR %q: %w", cidr, err)
+	}
+	return &netlink.Route{
+		Dst:       nladdr.IPNet,
+		LinkIndex: nlintf.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+	}, nil
+}
@@ -12,6 +12,18 @@ func SetRoutes(tun *tun.TunAdapter, log *log.Logger, cidrs []string) error {
 	return nil
 }
 
-func SetAddresses(tun *tun.TunAdapter, log *log.Logger, addresses []string) error {
+func SetAddresses(tun *tun.TunAdapter, log *log.Logger, addresses []string) ([]string, error) {
+	return nil, nil
+}
+
+func RemoveAddresses(tun *tun.TunAdapter, log *log.Logger, addresses []string) ([]string, error) {
+	return nil, nil
+}
+
+func AddRoute(tun *tun.TunAdapter, log *log.Logger, cidr string) error {
+	return nil
+}
+
+func RemoveRoute(tun *tun.TunAdapter, log *log.Logger, cidr string) error {
 	return nil
 }